@@ -0,0 +1,136 @@
+package ecs
+
+import (
+	"sync"
+)
+
+const (
+	// indexBits is the number of low bits of an ID holding the index.
+	indexBits = 32
+	indexMask = 1<<indexBits - 1
+)
+
+// PackID combines an index and a generation into a single entity ID. The index
+// occupies the lower 32 bits, and the generation the upper 32 bits, so the
+// first generation of every index is simply the index itself.
+func PackID(index, generation uint32) uint64 {
+	return uint64(generation)<<indexBits | uint64(index)
+}
+
+// IDIndex returns the index part of the given entity ID.
+func IDIndex(id uint64) uint32 {
+	return uint32(id & indexMask)
+}
+
+// IDGeneration returns the generation part of the given entity ID.
+func IDGeneration(id uint64) uint32 {
+	return uint32(id >> indexBits)
+}
+
+// An Allocator hands out and recycles entity IDs. A World frees the IDs of the
+// entities removed from it with its Allocator.
+type Allocator interface {
+	// NewID returns a new unique ID.
+	NewID() uint64
+
+	// NewIDs returns an amount of new unique IDs.
+	NewIDs(amount int) []uint64
+
+	// Free releases the given ID, after which it is no longer alive.
+	Free(id uint64)
+
+	// IsAlive reports whether the given ID was handed out and not freed since.
+	IsAlive(id uint64) bool
+}
+
+// idSlot keeps track of the current generation of a single index.
+type idSlot struct {
+	generation uint32
+	alive      bool
+}
+
+// IDAllocator hands out generational entity IDs. Freed indices are recycled with
+// their generation bumped, so an ID held onto after its entity was freed never
+// matches a live entity again. Index 0 is never handed out, which keeps the zero
+// BasicEntity distinct from every allocated one.
+//
+// The zero value is ready to use, and it is safe for concurrent use.
+type IDAllocator struct {
+	mu    sync.Mutex
+	slots []idSlot
+	free  []uint32
+}
+
+// NewID returns a new unique ID.
+func (a *IDAllocator) NewID() uint64 {
+	a.mu.Lock()
+	id := a.newID()
+	a.mu.Unlock()
+	return id
+}
+
+// NewIDs returns an amount of new unique IDs. It performs better than NewID for
+// large numbers of IDs.
+func (a *IDAllocator) NewIDs(amount int) []uint64 {
+	ids := make([]uint64, amount)
+
+	a.mu.Lock()
+	for i := range ids {
+		ids[i] = a.newID()
+	}
+	a.mu.Unlock()
+
+	return ids
+}
+
+func (a *IDAllocator) newID() uint64 {
+	if len(a.slots) == 0 {
+		// Reserve index 0.
+		a.slots = append(a.slots, idSlot{})
+	}
+
+	if n := len(a.free); n > 0 {
+		index := a.free[n-1]
+		a.free = a.free[:n-1]
+		a.slots[index].alive = true
+		return PackID(index, a.slots[index].generation)
+	}
+
+	index := uint32(len(a.slots))
+	a.slots = append(a.slots, idSlot{alive: true})
+	return PackID(index, 0)
+}
+
+// Free releases the given ID, so its index can be reused by a later entity with
+// a new generation. Freeing an ID that is not alive does nothing.
+func (a *IDAllocator) Free(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.isAlive(id) {
+		return
+	}
+
+	index := IDIndex(id)
+	a.slots[index].alive = false
+	a.slots[index].generation++
+	a.free = append(a.free, index)
+}
+
+// IsAlive reports whether the given ID was handed out by the allocator and has
+// not been freed since.
+func (a *IDAllocator) IsAlive(id uint64) bool {
+	a.mu.Lock()
+	alive := a.isAlive(id)
+	a.mu.Unlock()
+	return alive
+}
+
+func (a *IDAllocator) isAlive(id uint64) bool {
+	index := IDIndex(id)
+	if index == 0 || int(index) >= len(a.slots) {
+		return false
+	}
+	slot := a.slots[index]
+	return slot.alive && slot.generation == IDGeneration(id)
+}
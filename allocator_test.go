@@ -0,0 +1,103 @@
+package ecs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackID(t *testing.T) {
+	id := PackID(42, 7)
+	assert.Equal(t, uint32(42), IDIndex(id))
+	assert.Equal(t, uint32(7), IDGeneration(id))
+	assert.Equal(t, uint64(42), PackID(42, 0), "the first generation should equal the index")
+}
+
+// TestIDAllocatorRecycle makes sure freed indices are reused with a new generation
+func TestIDAllocatorRecycle(t *testing.T) {
+	a := IDAllocator{}
+	id1 := a.NewID()
+	id2 := a.NewID()
+	assert.NotEqual(t, uint32(0), IDIndex(id1), "index 0 should be reserved")
+	assert.NotEqual(t, id1, id2)
+
+	a.Free(id1)
+	assert.False(t, a.IsAlive(id1))
+	assert.True(t, a.IsAlive(id2))
+
+	id3 := a.NewID()
+	assert.Equal(t, IDIndex(id1), IDIndex(id3), "freed index was not recycled")
+	assert.Equal(t, IDGeneration(id1)+1, IDGeneration(id3), "generation was not bumped")
+	assert.NotEqual(t, id1, id3)
+	assert.True(t, a.IsAlive(id3))
+	assert.False(t, a.IsAlive(id1), "stale ID matched the recycled entity")
+}
+
+func TestIDAllocatorFreeTwice(t *testing.T) {
+	a := IDAllocator{}
+	id := a.NewID()
+	a.Free(id)
+	a.Free(id)
+	first := a.NewID()
+	second := a.NewID()
+	assert.NotEqual(t, IDIndex(first), IDIndex(second), "double free handed out an index twice")
+}
+
+func TestIDAllocatorIsAlive(t *testing.T) {
+	a := IDAllocator{}
+	assert.False(t, a.IsAlive(0))
+	id := a.NewID()
+	assert.False(t, a.IsAlive(PackID(IDIndex(id), 1)), "an ID that was never handed out is alive")
+	assert.False(t, a.IsAlive(PackID(IDIndex(id)+1, 0)), "an ID that was never handed out is alive")
+}
+
+func TestIDAllocatorConcurrent(t *testing.T) {
+	a := IDAllocator{}
+	const workers, perWorker = 8, 1000
+	ids := make([][]uint64, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				id := a.NewID()
+				if j%2 == 0 {
+					a.Free(id)
+					continue
+				}
+				ids[i] = append(ids[i], id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[uint64]struct{}{}
+	for _, list := range ids {
+		for _, id := range list {
+			if _, ok := seen[id]; ok {
+				t.Fatalf("ID %d was handed out twice", id)
+			}
+			seen[id] = struct{}{}
+			assert.True(t, a.IsAlive(id))
+		}
+	}
+}
+
+// TestWorldIsAlive makes sure stale copies of removed entities are detected
+func TestWorldIsAlive(t *testing.T) {
+	w := &World{}
+	e := NewBasic()
+	stale := e
+	w.AddEntity(e)
+	assert.True(t, w.IsAlive(e))
+
+	w.RemoveEntity(e)
+	assert.False(t, w.IsAlive(stale), "removed entity is still alive")
+
+	recycled := NewBasic()
+	assert.True(t, w.IsAlive(recycled))
+	assert.NotEqual(t, stale.ID(), recycled.ID(), "recycled entity shares an ID with a removed one")
+}
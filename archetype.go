@@ -0,0 +1,377 @@
+package ecs
+
+// componentMask is a bit set of component type IDs. Trailing zero words are
+// always trimmed, so equal sets have equal keys.
+type componentMask []uint64
+
+func (m componentMask) has(id int) bool {
+	word := id / 64
+	return word < len(m) && m[word]&(1<<uint(id%64)) != 0
+}
+
+// with returns a copy of the mask with the given ID set.
+func (m componentMask) with(id int) componentMask {
+	n := len(m)
+	if id/64 >= n {
+		n = id/64 + 1
+	}
+	out := make(componentMask, n)
+	copy(out, m)
+	out[id/64] |= 1 << uint(id%64)
+	return out
+}
+
+// without returns a copy of the mask with the given ID cleared.
+func (m componentMask) without(id int) componentMask {
+	out := make(componentMask, len(m))
+	copy(out, m)
+	if id/64 < len(out) {
+		out[id/64] &^= 1 << uint(id%64)
+	}
+	for len(out) > 0 && out[len(out)-1] == 0 {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// containsAll reports whether every ID set in o is set in m as well.
+func (m componentMask) containsAll(o componentMask) bool {
+	if len(o) > len(m) {
+		return false
+	}
+	for i, word := range o {
+		if m[i]&word != word {
+			return false
+		}
+	}
+	return true
+}
+
+// intersects reports whether any ID set in o is set in m as well.
+func (m componentMask) intersects(o componentMask) bool {
+	for i := 0; i < len(m) && i < len(o); i++ {
+		if m[i]&o[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns a string uniquely identifying the set, for use in maps.
+func (m componentMask) key() string {
+	b := make([]byte, 0, len(m)*8)
+	for _, word := range m {
+		for i := 0; i < 8; i++ {
+			b = append(b, byte(word>>(8*uint(i))))
+		}
+	}
+	return string(b)
+}
+
+// column is a type-erased column of an archetype, holding one component per
+// row.
+type column interface {
+	// pushFrom appends the component at the given row of src, which must be a
+	// column of the same type.
+	pushFrom(src column, row int)
+	// swapRemove removes the given row by moving the last row into its place.
+	swapRemove(row int)
+	// empty returns a new, empty column of the same type.
+	empty() column
+}
+
+// typedColumn is the column for components of type T.
+type typedColumn[T any] struct {
+	data []T
+}
+
+func (c *typedColumn[T]) pushFrom(src column, row int) {
+	c.data = append(c.data, src.(*typedColumn[T]).data[row])
+}
+
+func (c *typedColumn[T]) swapRemove(row int) {
+	last := len(c.data) - 1
+	c.data[row] = c.data[last]
+
+	var zero T
+	c.data[last] = zero
+	c.data = c.data[:last]
+}
+
+func (c *typedColumn[T]) empty() column {
+	return &typedColumn[T]{}
+}
+
+// An archetype is a table holding every entity with exactly the same set of
+// components, with a column per component type and a row per entity.
+type archetype struct {
+	mask componentMask
+	// types are the component types of the columns, sorted by ID.
+	types   []*componentType
+	columns []column
+	// columnOf maps component type IDs to their position in columns, or -1.
+	columnOf []int
+	// ids holds the entity ID of every row.
+	ids []uint64
+
+	// addEdges and removeEdges cache the archetype an entity moves to when the
+	// component type with the given ID is added or removed.
+	addEdges, removeEdges map[int]*archetype
+}
+
+func newArchetype(mask componentMask, types []*componentType, columns []column) *archetype {
+	a := &archetype{
+		mask:        mask,
+		types:       types,
+		columns:     columns,
+		addEdges:    make(map[int]*archetype),
+		removeEdges: make(map[int]*archetype),
+	}
+	for i, ct := range types {
+		for len(a.columnOf) <= ct.id {
+			a.columnOf = append(a.columnOf, -1)
+		}
+		a.columnOf[ct.id] = i
+	}
+	return a
+}
+
+// column returns the column for the given component type, or nil if the
+// archetype does not have one.
+func (a *archetype) column(ct *componentType) column {
+	if ct.id >= len(a.columnOf) || a.columnOf[ct.id] < 0 {
+		return nil
+	}
+	return a.columns[a.columnOf[ct.id]]
+}
+
+// swapRemove removes the given row, and returns the ID of the entity that was
+// moved into it, if any.
+func (a *archetype) swapRemove(row int) (uint64, bool) {
+	for _, c := range a.columns {
+		c.swapRemove(row)
+	}
+
+	last := len(a.ids) - 1
+	moved := a.ids[last]
+	a.ids[row] = moved
+	a.ids = a.ids[:last]
+	return moved, row != last
+}
+
+// entityLocation is the row of an entity in an archetype.
+type entityLocation struct {
+	archetype *archetype
+	row       int
+}
+
+// archetypeStore holds the archetypes of a World in ArchetypeStorage mode.
+type archetypeStore struct {
+	archetypes []*archetype
+	byMask     map[string]*archetype
+	locations  Storage[entityLocation]
+
+	// queries are offered every newly created archetype.
+	queries []*queryState
+}
+
+// archetypeFor returns the archetype for the given mask, creating it with the
+// given component types and columns when there is none yet.
+func (s *archetypeStore) archetypeFor(mask componentMask, types func() ([]*componentType, []column)) *archetype {
+	key := mask.key()
+	if a, ok := s.byMask[key]; ok {
+		return a
+	}
+
+	if s.byMask == nil {
+		s.byMask = make(map[string]*archetype)
+	}
+	ts, cs := types()
+	a := newArchetype(mask, ts, cs)
+	s.byMask[key] = a
+	s.archetypes = append(s.archetypes, a)
+	for _, qs := range s.queries {
+		qs.addArchetype(a)
+	}
+	return a
+}
+
+// withType returns the archetype an entity of src moves to when a component of
+// the given type is added. src may be nil for entities without components.
+func (s *archetypeStore) withType(src *archetype, ct *componentType) *archetype {
+	if src == nil {
+		return s.archetypeFor(componentMask(nil).with(ct.id), func() ([]*componentType, []column) {
+			return []*componentType{ct}, []column{ct.newColumn()}
+		})
+	}
+	if a, ok := src.addEdges[ct.id]; ok {
+		return a
+	}
+
+	a := s.archetypeFor(src.mask.with(ct.id), func() ([]*componentType, []column) {
+		types := make([]*componentType, 0, len(src.types)+1)
+		columns := make([]column, 0, len(src.types)+1)
+		added := false
+		for i, t := range src.types {
+			if !added && t.id > ct.id {
+				types = append(types, ct)
+				columns = append(columns, ct.newColumn())
+				added = true
+			}
+			types = append(types, t)
+			columns = append(columns, src.columns[i].empty())
+		}
+		if !added {
+			types = append(types, ct)
+			columns = append(columns, ct.newColumn())
+		}
+		return types, columns
+	})
+	src.addEdges[ct.id] = a
+	return a
+}
+
+// withoutType returns the archetype an entity of src moves to when its
+// component of the given type is removed, or nil if it has no components left.
+func (s *archetypeStore) withoutType(src *archetype, ct *componentType) *archetype {
+	if len(src.types) == 1 {
+		return nil
+	}
+	if a, ok := src.removeEdges[ct.id]; ok {
+		return a
+	}
+
+	a := s.archetypeFor(src.mask.without(ct.id), func() ([]*componentType, []column) {
+		types := make([]*componentType, 0, len(src.types)-1)
+		columns := make([]column, 0, len(src.types)-1)
+		for i, t := range src.types {
+			if t != ct {
+				types = append(types, t)
+				columns = append(columns, src.columns[i].empty())
+			}
+		}
+		return types, columns
+	})
+	src.removeEdges[ct.id] = a
+	return a
+}
+
+// move moves the entity at the given row of src to dst, copying the components
+// both archetypes have, and returns its new row. src may be nil, and dst may be
+// nil to drop the entity altogether.
+func (s *archetypeStore) move(id uint64, src *archetype, row int, dst *archetype) int {
+	newRow := -1
+	if dst != nil {
+		newRow = len(dst.ids)
+		dst.ids = append(dst.ids, id)
+		if src != nil {
+			for i, ct := range src.types {
+				if c := dst.column(ct); c != nil {
+					c.pushFrom(src.columns[i], row)
+				}
+			}
+		}
+		s.locations.Add(id, entityLocation{dst, newRow})
+	} else {
+		s.locations.Remove(id)
+	}
+
+	if src != nil {
+		if moved, ok := src.swapRemove(row); ok {
+			if loc, ok := s.locations.Get(moved); ok {
+				loc.row = row
+			}
+		}
+	}
+	return newRow
+}
+
+// archetypeAdd sets the component of type T of the entity with the given ID,
+// moving the entity to another archetype when it did not have one yet. It
+// returns nil if a newer generation of the entity has components, and removes
+// every component of an older generation, which is no longer alive.
+func archetypeAdd[T any](s *archetypeStore, ct *componentType, id uint64, c T) *T {
+	if s.locations.set.stale(id) {
+		return nil
+	}
+	if old, ok := s.locations.set.older(id); ok {
+		s.removeEntity(old)
+	}
+
+	var src *archetype
+	row := -1
+	if loc, ok := s.locations.Get(id); ok {
+		src, row = loc.archetype, loc.row
+		if col := src.column(ct); col != nil {
+			data := col.(*typedColumn[T]).data
+			data[row] = c
+			ct.added(id, true)
+			return &data[row]
+		}
+	}
+
+	dst := s.withType(src, ct)
+	newRow := s.move(id, src, row, dst)
+
+	// Every column but the new one received a component during the move.
+	col := dst.column(ct).(*typedColumn[T])
+	col.data = append(col.data, c)
+	ct.added(id, false)
+	return &col.data[newRow]
+}
+
+// archetypeGet returns the component of type T of the entity with the given ID.
+func archetypeGet[T any](s *archetypeStore, ct *componentType, id uint64) (*T, bool) {
+	loc, ok := s.locations.Get(id)
+	if !ok {
+		return nil, false
+	}
+	col := loc.archetype.column(ct)
+	if col == nil {
+		return nil, false
+	}
+	return &col.(*typedColumn[T]).data[loc.row], true
+}
+
+func (s *archetypeStore) has(ct *componentType, id uint64) bool {
+	loc, ok := s.locations.Get(id)
+	return ok && loc.archetype.mask.has(ct.id)
+}
+
+// remove removes the component of the given type of the entity with the given
+// ID, moving the entity to another archetype.
+func (s *archetypeStore) remove(ct *componentType, id uint64) bool {
+	loc, ok := s.locations.Get(id)
+	if !ok || !loc.archetype.mask.has(ct.id) {
+		return false
+	}
+	src, row := loc.archetype, loc.row
+	s.move(id, src, row, s.withoutType(src, ct))
+	ct.removed(id)
+	return true
+}
+
+// removeEntity removes every component of the entity with the given ID.
+func (s *archetypeStore) removeEntity(id uint64) {
+	loc, ok := s.locations.Get(id)
+	if !ok {
+		return
+	}
+	src := loc.archetype
+	s.move(id, src, loc.row, nil)
+	for _, ct := range src.types {
+		ct.removed(id)
+	}
+}
+
+// matching returns the archetypes having every component in with, and none of
+// the components in without.
+func (s *archetypeStore) matching(with, without componentMask) []*archetype {
+	var out []*archetype
+	for _, a := range s.archetypes {
+		if a.mask.containsAll(with) && !a.mask.intersects(without) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
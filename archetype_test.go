@@ -0,0 +1,67 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComponentMask(t *testing.T) {
+	m := componentMask(nil).with(1).with(70)
+	assert.True(t, m.has(1))
+	assert.True(t, m.has(70))
+	assert.False(t, m.has(2))
+	assert.False(t, m.has(200))
+
+	assert.True(t, m.containsAll(componentMask(nil).with(70)))
+	assert.False(t, m.containsAll(componentMask(nil).with(2)))
+	assert.True(t, m.intersects(componentMask(nil).with(1).with(2)))
+	assert.False(t, m.intersects(componentMask(nil).with(2)))
+
+	assert.Equal(t, componentMask(nil).with(1).key(), m.without(70).key(), "trailing words were not trimmed")
+	assert.Empty(t, m.without(1).without(70))
+}
+
+// TestArchetypeMoves makes sure entities move between archetypes as components
+// are added and removed
+func TestArchetypeMoves(t *testing.T) {
+	w := &World{}
+	w.SetStorageMode(ArchetypeStorage)
+	es := w.NewEntities(3)
+	for _, e := range es {
+		AddComponent(w, e.ID(), position{})
+	}
+	assert.Len(t, w.archetypes.archetypes, 1)
+
+	AddComponent(w, es[0].ID(), velocity{})
+	AddComponent(w, es[2].ID(), velocity{})
+	assert.Len(t, w.archetypes.archetypes, 2)
+
+	withPos := componentMask(nil).with(componentTypeOf[position](w).id)
+	withVel := componentMask(nil).with(componentTypeOf[velocity](w).id)
+	both := w.archetypes.matching(withPos.with(componentTypeOf[velocity](w).id), nil)
+	assert.Len(t, both, 1)
+	assert.ElementsMatch(t, []uint64{es[0].ID(), es[2].ID()}, both[0].ids)
+
+	onlyPos := w.archetypes.matching(withPos, withVel)
+	assert.Len(t, onlyPos, 1)
+	assert.Equal(t, []uint64{es[1].ID()}, onlyPos[0].ids)
+
+	RemoveComponent[velocity](w, es[0].ID())
+	assert.Len(t, w.archetypes.archetypes, 2, "moving back created a new archetype")
+	assert.ElementsMatch(t, []uint64{es[1].ID(), es[0].ID()}, onlyPos[0].ids)
+	assert.Equal(t, []uint64{es[2].ID()}, both[0].ids)
+
+	RemoveComponent[position](w, es[1].ID())
+	_, ok := w.archetypes.locations.Get(es[1].ID())
+	assert.False(t, ok, "entity without components still has a location")
+
+	for _, a := range w.archetypes.archetypes {
+		for row, id := range a.ids {
+			loc, ok := w.archetypes.locations.Get(id)
+			assert.True(t, ok)
+			assert.Equal(t, a, loc.archetype)
+			assert.Equal(t, row, loc.row)
+		}
+	}
+}
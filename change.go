@@ -0,0 +1,126 @@
+package ecs
+
+import (
+	"sync/atomic"
+)
+
+// componentTicks are the ticks at which a component was added and last changed.
+type componentTicks struct {
+	added, changed uint64
+}
+
+// removalLog logs the IDs of entities whose component of a type was removed,
+// in order. Every removal has a sequence number, so readers can keep track of
+// the removals they have seen, even after old ones are trimmed.
+type removalLog struct {
+	ids   []uint64
+	ticks []uint64
+	// first is the sequence number of ids[0].
+	first int
+}
+
+func (l *removalLog) append(id, tick uint64) {
+	l.ids = append(l.ids, id)
+	l.ticks = append(l.ticks, tick)
+}
+
+// end returns the sequence number of the next removal.
+func (l *removalLog) end() int {
+	return l.first + len(l.ids)
+}
+
+// trim drops the removals that happened before the given tick.
+func (l *removalLog) trim(before uint64) {
+	n := 0
+	for n < len(l.ticks) && l.ticks[n] < before {
+		n++
+	}
+	l.ids = append(l.ids[:0], l.ids[n:]...)
+	l.ticks = append(l.ticks[:0], l.ticks[n:]...)
+	l.first += n
+}
+
+// Tick returns the current tick of the World. It is incremented by Update
+// before every System is updated and after every iteration over a query, and
+// every change to a component is recorded with the tick at which it happened.
+// Systems updated in parallel, see SetWorkers, share the tick incremented
+// before their batch.
+func (w *World) Tick() uint64 {
+	return atomic.LoadUint64(&w.tick)
+}
+
+// nextTick increments the tick, and returns the new one. Systems updated in
+// parallel may increment it at the same time.
+func (w *World) nextTick() uint64 {
+	return atomic.AddUint64(&w.tick, 1)
+}
+
+// trimRemovals drops the removed components recorded before the previous
+// Update, so that readers have one whole frame to see every removal.
+func (w *World) trimRemovals() {
+	for _, ct := range w.components {
+		ct.removals.trim(w.frameTick)
+	}
+	w.frameTick = w.Tick() + 1
+}
+
+// MarkChanged records that the component of type T of the entity with the given
+// ID was changed, so that queries filtered by Changed report it. Components
+// changed through the pointers returned by the World are not detected without
+// calling it. Replacing a component via AddComponent marks it as changed as
+// well.
+func MarkChanged[T any](w *World, id uint64) {
+	ct := componentTypeOf[T](w)
+	if t, ok := ct.ticks.Get(id); ok {
+		t.changed = w.Tick()
+	}
+}
+
+// Added matches only entities whose component of type T was added since the
+// query was last iterated over. The first iteration matches every entity having
+// a component of type T.
+func Added[T any]() Filter {
+	return Filter{filterAdded, componentTypeOf[T]}
+}
+
+// Changed matches only entities whose component of type T was added or marked
+// as changed since the query was last iterated over. The first iteration
+// matches every entity having a component of type T.
+func Changed[T any]() Filter {
+	return Filter{filterChanged, componentTypeOf[T]}
+}
+
+// changeFilter is an Added or Changed filter of a query.
+type changeFilter struct {
+	ct    *componentType
+	added bool
+}
+
+// RemovedComponents reads the IDs of the entities whose component of type T was
+// removed, including by removing the entity itself. Removals are kept until the
+// end of the Update following the one they happened in, so reading at least
+// once per Update sees every removal.
+type RemovedComponents[T any] struct {
+	ct   *componentType
+	next int
+}
+
+// NewRemovedComponents creates a reader for the components of type T removed
+// from entities of the World from now on.
+func NewRemovedComponents[T any](w *World) *RemovedComponents[T] {
+	ct := componentTypeOf[T](w)
+	return &RemovedComponents[T]{ct: ct, next: ct.removals.end()}
+}
+
+// Read returns the IDs of the entities whose component was removed since the
+// last call to Read, in the order they were removed.
+func (r *RemovedComponents[T]) Read() []uint64 {
+	log := &r.ct.removals
+	start := r.next - log.first
+	if start < 0 {
+		start = 0
+	}
+	ids := append([]uint64(nil), log.ids[start:]...)
+	r.next = log.end()
+	return ids
+}
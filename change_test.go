@@ -0,0 +1,169 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// funcSystem is a System running a function on Update.
+type funcSystem struct {
+	update func(dt float32)
+}
+
+func (s *funcSystem) Update(dt float32) { s.update(dt) }
+func (*funcSystem) Remove(BasicEntity)  {}
+
+func TestChangeDetection(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			es := w.NewEntities(3)
+			for _, e := range es {
+				AddComponent(w, e.ID(), position{})
+			}
+
+			added := NewQuery1[position](w, Added[position]())
+			changed := NewQuery1[position](w, Changed[position]())
+			collect := func(q *Query1[position]) []uint64 {
+				var ids []uint64
+				q.Each(func(id uint64, p *position) {
+					ids = append(ids, id)
+				})
+				return ids
+			}
+
+			var seenAdded, seenChanged [][]uint64
+			var change func()
+			w.AddSystem(&funcSystem{func(float32) {
+				if change != nil {
+					change()
+				}
+			}})
+			w.AddSystem(&funcSystem{func(float32) {
+				seenAdded = append(seenAdded, collect(added))
+				seenChanged = append(seenChanged, collect(changed))
+			}})
+
+			w.Update(1)
+			assert.Len(t, seenAdded[0], 3, "the first iteration should report every component as added")
+			assert.Len(t, seenChanged[0], 3, "the first iteration should report every component as changed")
+
+			w.Update(1)
+			assert.Empty(t, seenAdded[1])
+			assert.Empty(t, seenChanged[1])
+
+			late := w.NewEntity()
+			change = func() {
+				MarkChanged[position](w, es[0].ID())
+				AddComponent(w, es[1].ID(), position{X: 1})
+				AddComponent(w, late.ID(), position{})
+			}
+			w.Update(1)
+			assert.Equal(t, []uint64{late.ID()}, seenAdded[2])
+			assert.ElementsMatch(t, []uint64{es[0].ID(), es[1].ID(), late.ID()}, seenChanged[2])
+
+			change = nil
+			w.Update(1)
+			assert.Empty(t, seenAdded[3])
+			assert.Empty(t, seenChanged[3])
+		})
+	}
+}
+
+// TestChangeDetectionLate makes sure changes made between two frames, and by a
+// system after iterating over its own query, are reported by the next iteration
+func TestChangeDetectionLate(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			es := w.NewEntities(3)
+			for _, e := range es {
+				AddComponent(w, e.ID(), position{})
+			}
+
+			changed := NewQuery1[position](w, Changed[position]())
+			var seen [][]uint64
+			var after func()
+			w.AddSystem(&funcSystem{func(float32) {
+				var ids []uint64
+				changed.Each(func(id uint64, p *position) {
+					ids = append(ids, id)
+				})
+				seen = append(seen, ids)
+				if after != nil {
+					after()
+				}
+			}})
+
+			w.Update(1)
+			assert.Len(t, seen[0], 3)
+
+			// Between frames
+			MarkChanged[position](w, es[0].ID())
+			AddComponent(w, es[1].ID(), position{X: 1})
+			w.Update(1)
+			assert.ElementsMatch(t, []uint64{es[0].ID(), es[1].ID()}, seen[1])
+
+			// After iterating, within the same system
+			after = func() { MarkChanged[position](w, es[2].ID()) }
+			w.Update(1)
+			assert.Empty(t, seen[2])
+			after = nil
+			w.Update(1)
+			assert.Equal(t, []uint64{es[2].ID()}, seen[3])
+		})
+	}
+}
+
+func TestRemovedComponents(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			es := w.NewEntities(3)
+			for _, e := range es {
+				AddComponent(w, e.ID(), position{})
+				AddComponent(w, e.ID(), velocity{})
+			}
+
+			r := NewRemovedComponents[position](w)
+			assert.Empty(t, r.Read())
+
+			RemoveComponent[position](w, es[0].ID())
+			w.RemoveEntity(es[1])
+			RemoveComponent[velocity](w, es[2].ID())
+			assert.Equal(t, []uint64{es[0].ID(), es[1].ID()}, r.Read())
+			assert.Empty(t, r.Read(), "removals were read twice")
+
+			slow := NewRemovedComponents[position](w)
+			RemoveComponent[position](w, es[2].ID())
+			w.Update(1)
+			assert.Equal(t, []uint64{es[2].ID()}, r.Read(), "a removal was dropped before the next Update")
+			w.Update(1)
+			w.Update(1)
+			assert.Empty(t, slow.Read(), "a removal was kept longer than the Update following it")
+		})
+	}
+}
+
+// TestStorageOfQueries makes sure components added via StorageOf are seen by
+// queries and change detection
+func TestStorageOfQueries(t *testing.T) {
+	w := &World{}
+	q := NewQuery1[position](w, Added[position]())
+	e := w.NewEntity()
+	StorageOf[position](w).Add(e.ID(), position{})
+	assert.Equal(t, 1, q.Count())
+
+	calls := 0
+	q.Each(func(id uint64, p *position) {
+		calls++
+	})
+	assert.Equal(t, 1, calls)
+
+	StorageOf[position](w).Remove(e.ID())
+	assert.Equal(t, 0, q.Count())
+}
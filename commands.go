@@ -0,0 +1,119 @@
+package ecs
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Commands records structural changes to a World, like adding and removing
+// entities and components, to apply them later. Systems should record such
+// changes rather than applying them during Update, since they would otherwise
+// change the entities of other systems and queries while those are being
+// iterated over. The World applies the recorded commands in the order they were
+// recorded at every sync point of Update: before the first System and after
+// every System.
+//
+// Commands is safe for concurrent use.
+type Commands struct {
+	mu       sync.Mutex
+	commands []func(*World)
+	// pending is the length of commands, which flush checks without locking
+	// so that sync points without commands cost next to nothing.
+	pending int32
+}
+
+// Commands returns the command buffer of the World.
+func (w *World) Commands() *Commands {
+	return &w.commands
+}
+
+// CommandsOf returns the command buffer the system should record its changes
+// in. Systems updated in parallel each get their own buffer, which are applied
+// after the batch in the order the systems are updated, while any other system
+// records in the Commands of the World. The commands recorded by parallel
+// systems in the Commands of the World are applied after those, in no
+// particular order.
+func (w *World) CommandsOf(system System) *Commands {
+	for i, sys := range w.batchSystems {
+		if sameSystem(sys, system) {
+			return &w.batchCommands[i]
+		}
+	}
+	return &w.commands
+}
+
+// FlushCommands applies every command recorded so far, including the ones
+// recorded by the commands themselves.
+func (w *World) FlushCommands() {
+	w.commands.flush(w)
+}
+
+// Run records fn, to be called with the World when the commands are applied.
+func (c *Commands) Run(fn func(w *World)) {
+	c.mu.Lock()
+	c.commands = append(c.commands, fn)
+	atomic.StoreInt32(&c.pending, int32(len(c.commands)))
+	c.mu.Unlock()
+}
+
+// Spawn records adding the entity to the World via World.AddEntity.
+func (c *Commands) Spawn(e Identifier) {
+	c.Run(func(w *World) {
+		w.AddEntity(e)
+	})
+}
+
+// Despawn records removing the entity from the World via World.RemoveEntity.
+func (c *Commands) Despawn(e Identifier) {
+	c.Run(func(w *World) {
+		w.RemoveEntity(e)
+	})
+}
+
+// Len returns the number of commands waiting to be applied.
+func (c *Commands) Len() int {
+	return int(atomic.LoadInt32(&c.pending))
+}
+
+func (c *Commands) flush(w *World) {
+	for atomic.LoadInt32(&c.pending) > 0 {
+		c.mu.Lock()
+		commands := c.commands
+		c.commands = nil
+		atomic.StoreInt32(&c.pending, 0)
+		c.mu.Unlock()
+
+		for _, command := range commands {
+			command(w)
+		}
+	}
+}
+
+// moveTo appends the commands to dst, leaving c empty.
+func (c *Commands) moveTo(dst *Commands) {
+	c.mu.Lock()
+	commands := c.commands
+	c.commands = nil
+	atomic.StoreInt32(&c.pending, 0)
+	c.mu.Unlock()
+
+	for _, command := range commands {
+		dst.Run(command)
+	}
+}
+
+// DeferAddComponent records adding the component to the entity with the given
+// ID via AddComponent.
+func DeferAddComponent[T any](c *Commands, id uint64, component T) {
+	c.Run(func(w *World) {
+		AddComponent(w, id, component)
+	})
+}
+
+// DeferRemoveComponent records removing the component of type T from the entity
+// with the given ID via RemoveComponent.
+func DeferRemoveComponent[T any](c *Commands, id uint64) {
+	c.Run(func(w *World) {
+		RemoveComponent[T](w, id)
+	})
+}
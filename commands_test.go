@@ -0,0 +1,115 @@
+package ecs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCommandsDeferred makes sure recorded commands are applied between systems
+func TestCommandsDeferred(t *testing.T) {
+	w := &World{}
+	sys12 := &MySystemOneTwo{}
+	w.AddSystem(sys12)
+
+	e := MyEntity12{BasicEntity: w.NewEntity()}
+	sys12.Add(&e.BasicEntity, &e.MyComponent1, &e.MyComponent2)
+	AddComponent(w, e.ID(), position{})
+
+	spawned := w.NewEntity()
+	var during, after int
+	w.AddSystem(&funcSystem{func(float32) {
+		w.Commands().Despawn(e.BasicEntity)
+		DeferAddComponent(w.Commands(), spawned.ID(), position{X: 1})
+		during = len(sys12.entities)
+	}})
+	w.AddSystem(&funcSystem{func(float32) {
+		after = len(sys12.entities)
+	}})
+
+	w.Update(1)
+	assert.Equal(t, 1, during, "the entity was removed while the system was running")
+	assert.Equal(t, 0, after, "the entity was not removed after the system")
+	assert.False(t, w.IsAlive(e))
+	assert.False(t, HasComponent[position](w, e.ID()))
+	p, ok := GetComponent[position](w, spawned.ID())
+	assert.True(t, ok, "the component was not added")
+	assert.Equal(t, float32(1), p.X)
+	assert.Equal(t, 0, w.Commands().Len())
+}
+
+func TestCommandsOrder(t *testing.T) {
+	w := &World{}
+	e := w.NewEntity()
+	c := w.Commands()
+	DeferAddComponent(c, e.ID(), position{X: 1})
+	DeferRemoveComponent[position](c, e.ID())
+	DeferAddComponent(c, e.ID(), position{X: 2})
+	c.Run(func(w *World) {
+		// Commands recorded while applying are applied in the same flush.
+		DeferAddComponent(w.Commands(), e.ID(), velocity{})
+	})
+	assert.False(t, HasComponent[position](w, e.ID()), "commands were applied before flushing")
+
+	w.FlushCommands()
+	p, ok := GetComponent[position](w, e.ID())
+	assert.True(t, ok)
+	assert.Equal(t, float32(2), p.X, "commands were not applied in order")
+	assert.True(t, HasComponent[velocity](w, e.ID()), "a command recorded by a command was not applied")
+}
+
+func TestCommandsSpawn(t *testing.T) {
+	w := &World{}
+	sys := &simpleSystem{}
+	var face *BasicFace
+	w.AddSystemInterface(sys, face, nil)
+
+	w.Commands().Spawn(&simpleEntity{w.NewEntity()})
+	assert.Empty(t, sys.entities)
+	w.Update(1)
+	assert.Len(t, sys.entities, 1, "the spawned entity was not added before the first system")
+}
+
+func TestCommandsConcurrent(t *testing.T) {
+	w := &World{}
+	es := w.NewEntities(100)
+
+	var wg sync.WaitGroup
+	for _, e := range es {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			DeferAddComponent(w.Commands(), id, position{})
+		}(e.ID())
+	}
+	wg.Wait()
+
+	w.FlushCommands()
+	assert.Equal(t, len(es), StorageOf[position](w).Len())
+}
+
+func BenchmarkCommandsAddRemoveUpdate(b *testing.B) {
+	w := &World{}
+	for i := 0; i < 100; i++ {
+		w.AddSystem(&MySystemOneTwo{})
+	}
+	for i := 0; i < 10000; i++ {
+		AddComponent(w, w.NewEntity().ID(), position{})
+	}
+	q := NewQuery1[position](w)
+	w.AddSystem(&funcSystem{func(float32) {
+		q.Each(func(id uint64, p *position) {
+			p.X++
+		})
+	}})
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e := w.NewEntity()
+		DeferAddComponent(w.Commands(), e.ID(), position{})
+		w.Update(1 / 120)
+		w.Commands().Despawn(e)
+	}
+}
@@ -0,0 +1,187 @@
+package ecs
+
+import (
+	"reflect"
+)
+
+// StorageMode selects how a World stores the components added via
+// AddComponent.
+type StorageMode int
+
+const (
+	// SparseStorage stores every component type in a Storage of its own, which
+	// keeps adding and removing components cheap. It is the default.
+	SparseStorage StorageMode = iota
+
+	// ArchetypeStorage stores entities with the same set of components together
+	// in a table, with a column per component type. Entities move to another
+	// table whenever a component is added or removed, which makes that more
+	// expensive, but queries are matched once per table instead of once per
+	// entity.
+	ArchetypeStorage
+)
+
+// componentType is the World's bookkeeping for a single type of component.
+type componentType struct {
+	w *World
+	// id is the position of the type in component masks.
+	id  int
+	typ reflect.Type
+
+	// storage holds the components in SparseStorage mode.
+	storage componentStorage
+	// newColumn creates an empty archetype column in ArchetypeStorage mode.
+	newColumn func() column
+
+	// queries are the queryStates requiring or excluding the type, which need
+	// to be updated when a component of the type is added or removed in
+	// SparseStorage mode.
+	queries []*queryState
+
+	// ticks holds the ticks at which the component of each entity was added
+	// and last changed.
+	ticks Storage[componentTicks]
+	// removals logs the entities whose component was removed.
+	removals removalLog
+}
+
+// componentTypeOf returns the componentType for T, registering it on the World
+// when needed. It is safe for concurrent use by systems updated in parallel.
+func componentTypeOf[T any](w *World) *componentType {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	w.registry.RLock()
+	c, ok := w.components[t]
+	w.registry.RUnlock()
+	if ok {
+		return c
+	}
+
+	w.registry.Lock()
+	defer w.registry.Unlock()
+	if c, ok := w.components[t]; ok {
+		return c
+	}
+
+	if w.components == nil {
+		w.components = make(map[reflect.Type]*componentType)
+	}
+	c = &componentType{
+		w:         w,
+		id:        len(w.components),
+		typ:       t,
+		newColumn: func() column { return &typedColumn[T]{} },
+	}
+	if w.storageMode == SparseStorage {
+		s := NewStorage[T]()
+		s.owner = c
+		c.storage = s
+	}
+	w.components[t] = c
+	return c
+}
+
+// SetStorageMode sets how the World stores components. It panics if any
+// component type was used with the World already.
+func (w *World) SetStorageMode(mode StorageMode) {
+	if len(w.components) > 0 {
+		panic("ecs: the storage mode must be set before components are added")
+	}
+	w.storageMode = mode
+}
+
+// StorageMode returns how the World stores components.
+func (w *World) StorageMode() StorageMode {
+	return w.storageMode
+}
+
+// AddComponent sets the component of type T of the entity with the given ID,
+// replacing the one it already has, and returns a pointer to the stored
+// component. The pointer is only valid until the next component of that type is
+// added or removed, or in ArchetypeStorage mode, any component of that entity.
+// It returns nil without adding the component if the ID is stale, that is a
+// newer generation of the entity has components.
+func AddComponent[T any](w *World, id uint64, c T) *T {
+	w.checkStructural()
+	ct := componentTypeOf[T](w)
+	if w.storageMode == ArchetypeStorage {
+		return archetypeAdd(&w.archetypes, ct, id, c)
+	}
+	return ct.storage.(*Storage[T]).Add(id, c)
+}
+
+// GetComponent returns the component of type T of the entity with the given ID,
+// and whether it has one. The pointer is valid as long as the one returned by
+// AddComponent.
+func GetComponent[T any](w *World, id uint64) (*T, bool) {
+	ct := componentTypeOf[T](w)
+	if w.storageMode == ArchetypeStorage {
+		return archetypeGet[T](&w.archetypes, ct, id)
+	}
+	return ct.storage.(*Storage[T]).Get(id)
+}
+
+// HasComponent reports whether the entity with the given ID has a component of
+// type T.
+func HasComponent[T any](w *World, id uint64) bool {
+	return w.hasComponent(componentTypeOf[T](w), id)
+}
+
+// RemoveComponent removes the component of type T of the entity with the given
+// ID, and reports whether it had one.
+func RemoveComponent[T any](w *World, id uint64) bool {
+	w.checkStructural()
+	ct := componentTypeOf[T](w)
+	if w.storageMode == ArchetypeStorage {
+		return w.archetypes.remove(ct, id)
+	}
+	return ct.storage.Remove(id)
+}
+
+func (w *World) hasComponent(ct *componentType, id uint64) bool {
+	if w.storageMode == ArchetypeStorage {
+		return w.archetypes.has(ct, id)
+	}
+	return ct.storage.Has(id)
+}
+
+// removeComponents removes every component of the entity with the given ID.
+func (w *World) removeComponents(id uint64) {
+	if w.storageMode == ArchetypeStorage {
+		w.archetypes.removeEntity(id)
+		return
+	}
+	for _, ct := range w.components {
+		ct.storage.Remove(id)
+	}
+}
+
+// added records that a component of the type was added to the entity with the
+// given ID, or replaced if it had one already.
+func (ct *componentType) added(id uint64, replaced bool) {
+	tick := ct.w.Tick()
+	if replaced {
+		if t, ok := ct.ticks.Get(id); ok {
+			t.changed = tick
+		}
+		return
+	}
+
+	ct.ticks.Add(id, componentTicks{added: tick, changed: tick})
+	if ct.w.storageMode == SparseStorage {
+		for _, qs := range ct.queries {
+			qs.update(ct.w, id)
+		}
+	}
+}
+
+// removed records that the component of the type was removed from the entity
+// with the given ID.
+func (ct *componentType) removed(id uint64) {
+	ct.ticks.Remove(id)
+	ct.removals.append(id, ct.w.Tick())
+	if ct.w.storageMode == SparseStorage {
+		for _, qs := range ct.queries {
+			qs.update(ct.w, id)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var storageModes = []struct {
+	name string
+	mode StorageMode
+}{
+	{"sparse", SparseStorage},
+	{"archetype", ArchetypeStorage},
+}
+
+func TestComponents(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			es := w.NewEntities(3)
+			for i, e := range es {
+				AddComponent(w, e.ID(), position{X: float32(i)})
+			}
+			AddComponent(w, es[1].ID(), velocity{X: 1})
+
+			assert.True(t, HasComponent[position](w, es[0].ID()))
+			assert.False(t, HasComponent[velocity](w, es[0].ID()))
+			assert.True(t, HasComponent[velocity](w, es[1].ID()))
+
+			p, ok := GetComponent[position](w, es[1].ID())
+			assert.True(t, ok)
+			assert.Equal(t, float32(1), p.X, "position was lost when adding velocity")
+			p.Y = 3
+			p, _ = GetComponent[position](w, es[1].ID())
+			assert.Equal(t, float32(3), p.Y, "changes through the returned pointer were lost")
+
+			AddComponent(w, es[1].ID(), position{X: 10})
+			p, _ = GetComponent[position](w, es[1].ID())
+			assert.Equal(t, float32(10), p.X, "adding an existing component should replace it")
+
+			assert.True(t, RemoveComponent[position](w, es[1].ID()))
+			assert.False(t, RemoveComponent[position](w, es[1].ID()))
+			assert.False(t, HasComponent[position](w, es[1].ID()))
+			v, ok := GetComponent[velocity](w, es[1].ID())
+			assert.True(t, ok)
+			assert.Equal(t, float32(1), v.X, "velocity was lost when removing position")
+
+			w.RemoveEntity(es[1])
+			assert.False(t, HasComponent[velocity](w, es[1].ID()), "RemoveEntity did not remove the components")
+			for i, e := range []BasicEntity{es[0], es[2]} {
+				p, ok := GetComponent[position](w, e.ID())
+				assert.True(t, ok)
+				assert.Equal(t, float32(i*2), p.X, "removing an entity changed the components of another")
+			}
+		})
+	}
+}
+
+// TestStaleComponents makes sure a stale ID does not take the components of the
+// entity which reuses its index
+func TestStaleComponents(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetAllocator(&IDAllocator{})
+			w.SetStorageMode(tt.mode)
+			old := w.NewEntity()
+			AddComponent(w, old.ID(), position{X: 1})
+			w.RemoveEntity(old)
+
+			e := w.NewEntity()
+			assert.Equal(t, IDIndex(old.ID()), IDIndex(e.ID()), "the index was not reused")
+			AddComponent(w, e.ID(), position{X: 2})
+			q := NewQuery1[position](w)
+
+			assert.Nil(t, AddComponent(w, old.ID(), position{X: 3}))
+			assert.False(t, HasComponent[position](w, old.ID()))
+			p, ok := GetComponent[position](w, e.ID())
+			assert.True(t, ok, "the stale ID took the component of the live entity")
+			assert.Equal(t, float32(2), p.X)
+			assert.Equal(t, 1, q.Count())
+
+			// An older generation which was never removed makes way for the
+			// newer one.
+			other, older, newer := PackID(8, 0), PackID(7, 0), PackID(7, 1)
+			AddComponent(w, other, position{X: 8})
+			AddComponent(w, older, position{X: 7})
+			AddComponent(w, newer, position{X: 7})
+			assert.False(t, HasComponent[position](w, older), "the older generation kept its component")
+			assert.Equal(t, 3, q.Count())
+			var ids []uint64
+			q.Each(func(id uint64, p *position) {
+				ids = append(ids, id)
+			})
+			assert.ElementsMatch(t, []uint64{e.ID(), other, newer}, ids)
+
+			assert.True(t, RemoveComponent[position](w, newer))
+			assert.True(t, RemoveComponent[position](w, other))
+			assert.Equal(t, 1, q.Count())
+		})
+	}
+}
+
+// TestStaleComponentsEvicted makes sure the components of an older generation
+// which was never removed are removed once a newer generation gets one
+func TestStaleComponentsEvicted(t *testing.T) {
+	w := &World{}
+	old, e := PackID(7, 0), PackID(7, 1)
+	AddComponent(w, old, position{X: 1})
+	AddComponent(w, old, velocity{X: 1})
+	q := NewQuery2[position, velocity](w)
+	removed := NewRemovedComponents[velocity](w)
+	assert.Equal(t, 1, q.Count())
+
+	AddComponent(w, e, position{X: 2})
+	assert.False(t, HasComponent[velocity](w, old), "the older generation kept its components")
+	assert.Equal(t, 0, q.Count())
+	q.Each(func(id uint64, p *position, v *velocity) {
+		t.Errorf("the query yielded the older generation %d", id)
+	})
+	assert.Equal(t, []uint64{old}, removed.Read())
+	assert.Equal(t, 1, NewQuery1[position](w).Count())
+}
+
+func TestSetStorageMode(t *testing.T) {
+	w := &World{}
+	assert.Equal(t, SparseStorage, w.StorageMode())
+	w.SetStorageMode(ArchetypeStorage)
+	assert.Equal(t, ArchetypeStorage, w.StorageMode())
+	assert.Panics(t, func() { StorageOf[position](w) }, "StorageOf should not be available for archetypes")
+
+	AddComponent(w, w.NewEntity().ID(), position{})
+	assert.Panics(t, func() { w.SetStorageMode(SparseStorage) }, "changed the storage mode of a World with components")
+}
@@ -1,11 +1,19 @@
 package ecs
 
 import (
-	"sync/atomic"
+	"errors"
 )
 
+// The errors returned by TryAppendChild.
 var (
-	idInc uint64
+	ErrSelfParent     = errors.New("ecs: an entity cannot be its own child")
+	ErrHierarchyCycle = errors.New("ecs: an entity cannot be the child of its descendent")
+)
+
+var (
+	// defaultAllocator provides the IDs of NewBasic and NewBasics, and of every
+	// World without an Allocator of its own.
+	defaultAllocator IDAllocator
 )
 
 // A BasicEntity is simply a set of components with a unique ID attached to it,
@@ -16,6 +24,9 @@ type BasicEntity struct {
 	id       uint64
 	parent   *BasicEntity
 	children []*BasicEntity
+	// shared is set when the ID was handed out by the default allocator of
+	// NewBasic and NewBasics, rather than the Allocator of a World.
+	shared bool
 }
 
 // Identifier is an interface for anything that implements the basic ID() uint64,
@@ -32,7 +43,7 @@ type IdentifierSlice []Identifier
 // NewBasic creates a new Entity with a new unique identifier. It is safe for
 // concurrent use.
 func NewBasic() BasicEntity {
-	return BasicEntity{id: atomic.AddUint64(&idInc, 1)}
+	return BasicEntity{id: defaultAllocator.NewID(), shared: true}
 }
 
 // NewBasics creates an amount of new entities with a new unique identifiers. It
@@ -41,9 +52,9 @@ func NewBasic() BasicEntity {
 func NewBasics(amount int) []BasicEntity {
 	entities := make([]BasicEntity, amount)
 
-	lastID := atomic.AddUint64(&idInc, uint64(amount))
-	for i := 0; i < amount; i++ {
-		entities[i].id = lastID - uint64(amount) + uint64(i) + 1
+	for i, id := range defaultAllocator.NewIDs(amount) {
+		entities[i].id = id
+		entities[i].shared = true
 	}
 
 	return entities
@@ -65,12 +76,38 @@ func (e *BasicEntity) GetBasicEntity() *BasicEntity {
 	return e
 }
 
-// AppendChild appends a child to the BasicEntity
+// AppendChild appends a child to the BasicEntity, detaching it from its previous
+// parent. It panics if the child is the BasicEntity itself or one of its
+// ancestors, see TryAppendChild.
 func (e *BasicEntity) AppendChild(child *BasicEntity) {
+	if err := e.TryAppendChild(child); err != nil {
+		panic(err)
+	}
+}
+
+// TryAppendChild appends a child to the BasicEntity, detaching it from its
+// previous parent. It returns ErrSelfParent if the child is the BasicEntity
+// itself, and ErrHierarchyCycle if it is one of its ancestors, in which case
+// nothing changes. Entities are compared by ID, so this holds for copies of
+// them as well.
+func (e *BasicEntity) TryAppendChild(child *BasicEntity) error {
+	if child.ID() == e.ID() {
+		return ErrSelfParent
+	}
+	if child.IsAncestorOf(e) {
+		return ErrHierarchyCycle
+	}
+
+	if child.parent != nil {
+		child.parent.RemoveChild(child)
+	}
 	child.parent = e
 	e.children = append(e.children, child)
+	return nil
 }
 
+// RemoveChild removes a child from the BasicEntity, which is no longer its parent
+// afterwards.
 func (e *BasicEntity) RemoveChild(child *BasicEntity) {
 	delete := -1
 	for i, v := range e.children {
@@ -79,8 +116,15 @@ func (e *BasicEntity) RemoveChild(child *BasicEntity) {
 			break
 		}
 	}
-	if delete >= 0 {
-		e.children = append(e.children[:delete], e.children[delete+1:]...)
+	if delete < 0 {
+		return
+	}
+	// The child may be a copy of the entity held here, so the parent is cleared
+	// on the held entity.
+	removed := e.children[delete]
+	e.children = append(e.children[:delete], e.children[delete+1:]...)
+	if removed.parent == e {
+		removed.parent = nil
 	}
 }
 
@@ -93,27 +137,132 @@ func (e *BasicEntity) Children() []BasicEntity {
 	return ret
 }
 
-// var visited map[uint64]struct{}
-// var descs []*BasicEntity
-
-// Descendents returns the children and their children all the way down the tree.
+// Descendents returns the children and their children all the way down the tree,
+// every child before its parent.
 func (e *BasicEntity) Descendents() []BasicEntity {
-	return descendents([]BasicEntity{}, e, e)
+	ret := []BasicEntity{}
+	e.WalkPostOrder(func(d *BasicEntity) bool {
+		ret = append(ret, *d)
+		return true
+	})
+	return ret
 }
 
-func descendents(in []BasicEntity, this, top *BasicEntity) []BasicEntity {
-	for _, child := range this.children {
-		in = descendents(in, child, top)
+// Parent returns the parent of the BasicEntity
+func (e *BasicEntity) Parent() *BasicEntity {
+	return e.parent
+}
+
+// WalkPreOrder calls fn for the descendents of the BasicEntity, every parent
+// before its children, until fn returns false.
+func (e *BasicEntity) WalkPreOrder(fn func(*BasicEntity) bool) {
+	stack := make([]*BasicEntity, 0, len(e.children))
+	for i := len(e.children) - 1; i >= 0; i-- {
+		stack = append(stack, e.children[i])
 	}
-	if this.ID() == top.ID() {
-		return in
+	for len(stack) > 0 {
+		d := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !fn(d) {
+			return
+		}
+		for i := len(d.children) - 1; i >= 0; i-- {
+			stack = append(stack, d.children[i])
+		}
 	}
-	return append(in, *this)
 }
 
-// Parent returns the parent of the BasicEntity
-func (e *BasicEntity) Parent() *BasicEntity {
-	return e.parent
+// WalkPostOrder calls fn for the descendents of the BasicEntity, every child
+// before its parent, until fn returns false.
+func (e *BasicEntity) WalkPostOrder(fn func(*BasicEntity) bool) {
+	// Every frame holds an entity, and the index of its next child to visit.
+	type frame struct {
+		e    *BasicEntity
+		next int
+	}
+	stack := []frame{{e, 0}}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next < len(top.e.children) {
+			child := top.e.children[top.next]
+			top.next++
+			stack = append(stack, frame{child, 0})
+			continue
+		}
+
+		stack = stack[:len(stack)-1]
+		if len(stack) > 0 && !fn(top.e) {
+			return
+		}
+	}
+}
+
+// WalkBreadthFirst calls fn for the descendents of the BasicEntity, level by
+// level, until fn returns false.
+func (e *BasicEntity) WalkBreadthFirst(fn func(*BasicEntity) bool) {
+	queue := append([]*BasicEntity(nil), e.children...)
+	for i := 0; i < len(queue); i++ {
+		if !fn(queue[i]) {
+			return
+		}
+		queue = append(queue, queue[i].children...)
+	}
+}
+
+// Ancestors returns the parent of the BasicEntity, its parent, and so on up to
+// the root.
+func (e *BasicEntity) Ancestors() []*BasicEntity {
+	var ret []*BasicEntity
+	for p := e.parent; p != nil; p = p.parent {
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// Siblings returns the other children of the parent of the BasicEntity.
+func (e *BasicEntity) Siblings() []*BasicEntity {
+	if e.parent == nil {
+		return nil
+	}
+	ret := make([]*BasicEntity, 0, len(e.parent.children))
+	for _, child := range e.parent.children {
+		if child.ID() != e.ID() {
+			ret = append(ret, child)
+		}
+	}
+	return ret
+}
+
+// Root returns the topmost ancestor of the BasicEntity, or the BasicEntity
+// itself if it has no parent.
+func (e *BasicEntity) Root() *BasicEntity {
+	root := e
+	for root.parent != nil {
+		root = root.parent
+	}
+	return root
+}
+
+// Depth returns the number of ancestors of the BasicEntity, which is 0 for a
+// root.
+func (e *BasicEntity) Depth() int {
+	depth := 0
+	for p := e.parent; p != nil; p = p.parent {
+		depth++
+	}
+	return depth
+}
+
+// IsAncestorOf reports whether the BasicEntity is an ancestor of other. Entities
+// are compared by ID, like RemoveChild does, so copies of an entity are treated
+// as the entity itself.
+func (e *BasicEntity) IsAncestorOf(other *BasicEntity) bool {
+	for p := other.parent; p != nil; p = p.parent {
+		if p.ID() == e.ID() {
+			return true
+		}
+	}
+	return false
 }
 
 // Len returns the length of the underlying slice
@@ -421,6 +421,21 @@ func TestRemoveChild(t *testing.T) {
 	}
 }
 
+func TestRemoveChildCopy(t *testing.T) {
+	p, q := NewBasic(), NewBasic()
+	o := NewBasic()
+	p.AppendChild(&o)
+
+	// Reparenting a copy removes the original from p, which is then no longer
+	// its parent.
+	c := o
+	q.AppendChild(&c)
+	assert.Empty(t, p.Children())
+	assert.Nil(t, o.Parent())
+	assert.Equal(t, &q, c.Parent())
+	assert.Empty(t, o.Siblings())
+}
+
 func TestDescendents(t *testing.T) {
 	parent := NewBasic()
 	children := NewBasics(7)
@@ -451,6 +466,188 @@ func TestDescendents(t *testing.T) {
 	}
 }
 
+// TestAppendChildReparents makes sure a child only ever has one parent
+func TestAppendChildReparents(t *testing.T) {
+	first, second := NewBasic(), NewBasic()
+	child := NewBasic()
+	first.AppendChild(&child)
+	second.AppendChild(&child)
+
+	assert.Empty(t, first.Children(), "child is still listed under its previous parent")
+	assert.Len(t, second.Children(), 1)
+	assert.Equal(t, &second, child.Parent())
+
+	second.RemoveChild(&child)
+	assert.Nil(t, child.Parent(), "removed child still has a parent")
+}
+
+func TestTryAppendChild(t *testing.T) {
+	es := NewBasics(4)
+	es[0].AppendChild(&es[1])
+	es[1].AppendChild(&es[2])
+	es[2].AppendChild(&es[3])
+
+	tests := []struct {
+		name          string
+		parent, child *BasicEntity
+		err           error
+	}{
+		{"self", &es[1], &es[1], ErrSelfParent},
+		{"parent", &es[1], &es[0], ErrHierarchyCycle},
+		{"ancestor", &es[3], &es[0], ErrHierarchyCycle},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.err, tt.parent.TryAppendChild(tt.child))
+			assert.Panics(t, func() { tt.parent.AppendChild(tt.child) })
+		})
+	}
+
+	// The rejected cycles did not change the tree
+	assert.Nil(t, es[0].Parent())
+	for i := 1; i < len(es); i++ {
+		assert.Equal(t, &es[i-1], es[i].Parent())
+	}
+	assert.Len(t, es[0].Descendents(), 3)
+
+	// Moving a subtree down another branch of its parent is allowed
+	sibling := NewBasic()
+	es[0].AppendChild(&sibling)
+	assert.NoError(t, sibling.TryAppendChild(&es[1]))
+	assert.Equal(t, []BasicEntity{sibling}, es[0].Children())
+	assert.Len(t, es[0].Descendents(), 4)
+}
+
+// TestTryAppendChildCopies makes sure copies of an ancestor, like those returned
+// by Descendents and Children, are recognized as the ancestor itself
+func TestTryAppendChildCopies(t *testing.T) {
+	root := NewBasic()
+	es := NewBasics(2)
+	root.AppendChild(&es[0])
+	es[0].AppendChild(&es[1])
+
+	copies := root.Descendents()
+	assert.Equal(t, es[0].ID(), copies[1].ID())
+	assert.Equal(t, ErrHierarchyCycle, es[1].TryAppendChild(&copies[1]))
+	assert.Equal(t, ErrSelfParent, es[1].TryAppendChild(&copies[0]))
+
+	children := root.Children()
+	assert.Equal(t, ErrHierarchyCycle, es[1].TryAppendChild(&children[0]))
+	assert.True(t, children[0].IsAncestorOf(&es[1]))
+	assert.Len(t, root.Descendents(), 2)
+}
+
+func TestDeepHierarchy(t *testing.T) {
+	es := NewBasics(10000)
+	for i := 1; i < len(es); i++ {
+		es[i-1].AppendChild(&es[i])
+	}
+
+	assert.Len(t, es[0].Descendents(), len(es)-1)
+	assert.Equal(t, ErrHierarchyCycle, es[len(es)-1].TryAppendChild(&es[0]))
+
+	leaf := &es[len(es)-1]
+	assert.Equal(t, len(es)-1, leaf.Depth())
+	assert.Equal(t, &es[0], leaf.Root())
+	assert.Len(t, leaf.Ancestors(), len(es)-1)
+
+	n := 0
+	for _, walk := range []func(func(*BasicEntity) bool){es[0].WalkPreOrder, es[0].WalkPostOrder, es[0].WalkBreadthFirst} {
+		walk(func(*BasicEntity) bool {
+			n++
+			return true
+		})
+	}
+	assert.Equal(t, 3*(len(es)-1), n)
+}
+
+// newTestTree returns the tree
+//
+//	0
+//	├── 1
+//	│   ├── 3
+//	│   │   └── 6
+//	│   └── 4
+//	├── 2
+//	│   └── 5
+//	└── 7
+func newTestTree() []BasicEntity {
+	es := NewBasics(8)
+	es[0].AppendChild(&es[1])
+	es[0].AppendChild(&es[2])
+	es[0].AppendChild(&es[7])
+	es[1].AppendChild(&es[3])
+	es[1].AppendChild(&es[4])
+	es[2].AppendChild(&es[5])
+	es[3].AppendChild(&es[6])
+	return es
+}
+
+// walkOrder returns the positions in es of the entities walk visits, stopping
+// after limit entities.
+func walkOrder(es []BasicEntity, walk func(func(*BasicEntity) bool), limit int) []int {
+	var order []int
+	walk(func(e *BasicEntity) bool {
+		for i := range es {
+			if &es[i] == e {
+				order = append(order, i)
+			}
+		}
+		return len(order) < limit
+	})
+	return order
+}
+
+func TestWalk(t *testing.T) {
+	es := newTestTree()
+	root := &es[0]
+
+	assert.Equal(t, []int{1, 3, 6, 4, 2, 5, 7}, walkOrder(es, root.WalkPreOrder, 10))
+	assert.Equal(t, []int{6, 3, 4, 1, 5, 2, 7}, walkOrder(es, root.WalkPostOrder, 10))
+	assert.Equal(t, []int{1, 2, 7, 3, 4, 5, 6}, walkOrder(es, root.WalkBreadthFirst, 10))
+
+	assert.Equal(t, []int{1, 3, 6}, walkOrder(es, root.WalkPreOrder, 3), "walk did not stop")
+	assert.Equal(t, []int{6, 3, 4}, walkOrder(es, root.WalkPostOrder, 3), "walk did not stop")
+	assert.Equal(t, []int{1, 2, 7}, walkOrder(es, root.WalkBreadthFirst, 3), "walk did not stop")
+
+	assert.Empty(t, walkOrder(es, es[6].WalkPreOrder, 10))
+
+	var ids []uint64
+	for _, d := range root.Descendents() {
+		ids = append(ids, d.ID())
+	}
+	assert.Equal(t, []uint64{es[6].ID(), es[3].ID(), es[4].ID(), es[1].ID(), es[5].ID(), es[2].ID(), es[7].ID()}, ids,
+		"Descendents is not in post-order")
+}
+
+func TestHierarchyQueries(t *testing.T) {
+	es := newTestTree()
+
+	assert.Equal(t, []*BasicEntity{&es[3], &es[1], &es[0]}, es[6].Ancestors())
+	assert.Empty(t, es[0].Ancestors())
+
+	assert.Equal(t, []*BasicEntity{&es[1], &es[7]}, es[2].Siblings())
+	assert.Empty(t, es[6].Siblings())
+	assert.Empty(t, es[0].Siblings())
+
+	assert.Equal(t, &es[0], es[6].Root())
+	assert.Equal(t, &es[0], es[0].Root())
+
+	assert.Equal(t, 3, es[6].Depth())
+	assert.Equal(t, 0, es[0].Depth())
+
+	// An entity its parent does not hold as a child has no siblings.
+	detached := NewBasic()
+	detached.parent = &es[6]
+	assert.Empty(t, detached.Siblings())
+
+	assert.True(t, es[0].IsAncestorOf(&es[6]))
+	assert.True(t, es[3].IsAncestorOf(&es[6]))
+	assert.False(t, es[6].IsAncestorOf(&es[3]))
+	assert.False(t, es[2].IsAncestorOf(&es[6]))
+	assert.False(t, es[6].IsAncestorOf(&es[6]))
+}
+
 func BenchmarkIdiomatic(b *testing.B) {
 	preload := func() {}
 	setup := func(w *World) {
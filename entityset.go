@@ -0,0 +1,83 @@
+package ecs
+
+// EntitySet holds the entities of a System, typically structs of a
+// *BasicEntity and the components the System uses. Entities are packed in a
+// slice, which is indexed by ID so that finding and removing an entity takes
+// constant time instead of a linear scan. Removing an entity moves the last one
+// into its place, so the order of the entities is not preserved.
+//
+// Systems may embed an EntitySet, which provides their Remove method:
+//
+//	type MoveSystem struct {
+//	    ecs.EntitySet[moveEntity]
+//	}
+type EntitySet[T Identifier] struct {
+	entities []T
+	index    map[uint64]int
+}
+
+// Add adds the entity to the set, replacing the one with the same ID if there
+// is one.
+func (s *EntitySet[T]) Add(e T) {
+	if s.index == nil {
+		s.index = make(map[uint64]int)
+	}
+	if i, ok := s.index[e.ID()]; ok {
+		s.entities[i] = e
+		return
+	}
+	s.index[e.ID()] = len(s.entities)
+	s.entities = append(s.entities, e)
+}
+
+// Remove removes the entity with the ID of e from the set, if there is one.
+func (s *EntitySet[T]) Remove(e BasicEntity) {
+	s.RemoveID(e.ID())
+}
+
+// RemoveID removes the entity with the given ID from the set, and reports
+// whether there was one.
+func (s *EntitySet[T]) RemoveID(id uint64) bool {
+	i, ok := s.index[id]
+	if !ok {
+		return false
+	}
+	delete(s.index, id)
+
+	last := len(s.entities) - 1
+	if i != last {
+		s.entities[i] = s.entities[last]
+		s.index[s.entities[i].ID()] = i
+	}
+	var zero T
+	s.entities[last] = zero
+	s.entities = s.entities[:last]
+	return true
+}
+
+// Get returns the entity with the given ID, and whether there is one.
+func (s *EntitySet[T]) Get(id uint64) (T, bool) {
+	i, ok := s.index[id]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	return s.entities[i], true
+}
+
+// Has reports whether the set holds an entity with the given ID.
+func (s *EntitySet[T]) Has(id uint64) bool {
+	_, ok := s.index[id]
+	return ok
+}
+
+// Len returns the number of entities in the set.
+func (s *EntitySet[T]) Len() int {
+	return len(s.entities)
+}
+
+// Entities returns the entities in the set. The slice is only valid until the
+// set is changed.
+func (s *EntitySet[T]) Entities() []T {
+	return s.entities
+}
@@ -0,0 +1,101 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setEntity12 is the entity of setSystemOneTwo.
+type setEntity12 struct {
+	*BasicEntity
+	c1 *MyComponent1
+	c2 *MyComponent2
+}
+
+// setSystemOneTwo is MySystemOneTwo, storing its entities in an EntitySet.
+type setSystemOneTwo struct {
+	EntitySet[setEntity12]
+}
+
+func (sys *setSystemOneTwo) Update(dt float32) {
+	for _, e := range sys.Entities() {
+		e.c1.B++
+		e.c2.D++
+	}
+}
+
+func (sys *setSystemOneTwo) AddByInterface(o Identifier) {
+	obj := o.(MySystemOneTwoable)
+	sys.Add(setEntity12{obj.GetBasicEntity(), obj.GetMyComponent1(), obj.GetMyComponent2()})
+}
+
+func TestEntitySet(t *testing.T) {
+	var s EntitySet[*BasicEntity]
+	es := NewBasics(4)
+	for i := range es {
+		s.Add(&es[i])
+	}
+	s.Add(&es[2])
+	assert.Equal(t, 4, s.Len(), "adding an entity twice replaces it")
+
+	s.Remove(es[1])
+	assert.False(t, s.Has(es[1].ID()))
+	assert.False(t, s.RemoveID(es[1].ID()), "the entity was removed already")
+	assert.Equal(t, []*BasicEntity{&es[0], &es[3], &es[2]}, s.Entities(), "the last entity takes its place")
+
+	e, ok := s.Get(es[3].ID())
+	assert.True(t, ok)
+	assert.Equal(t, &es[3], e)
+
+	assert.True(t, s.RemoveID(es[2].ID()))
+	assert.True(t, s.RemoveID(es[0].ID()))
+	assert.Equal(t, []*BasicEntity{&es[3]}, s.Entities())
+	_, ok = s.Get(es[0].ID())
+	assert.False(t, ok)
+}
+
+func TestEntitySet_System(t *testing.T) {
+	w := &World{}
+	sys := &setSystemOneTwo{}
+	var able *MySystemOneTwoable
+	w.AddSystemInterface(sys, able, nil)
+
+	e := &MyEntity12{BasicEntity: w.NewEntity()}
+	w.AddEntity(e)
+	w.Update(1)
+	assert.Equal(t, 1, e.MyComponent1.B)
+
+	w.RemoveEntity(e)
+	assert.Zero(t, sys.Len())
+}
+
+// benchRemoveUpdate updates 100 systems of 10000 entities each, and adds and
+// removes an entity, like BenchmarkRemoveUpdate.
+func benchRemoveUpdate(b *testing.B, newSystem func() SystemAddByInterfacer) {
+	w := &World{}
+	var able *MySystemOneTwoable
+	for i := 0; i < 100; i++ {
+		w.AddSystemInterface(newSystem(), able, nil)
+	}
+	for i := 0; i < 10000; i++ {
+		w.AddEntity(&MyEntity12{BasicEntity: NewBasic()})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Update(1 / 120)
+		e12 := &MyEntity12{BasicEntity: NewBasic()}
+		w.AddEntity(e12)
+		w.RemoveEntity(e12)
+	}
+}
+
+func BenchmarkRemoveUpdateLinear(b *testing.B) {
+	benchRemoveUpdate(b, func() SystemAddByInterfacer { return &MySystemOneTwo{} })
+}
+
+func BenchmarkRemoveUpdateEntitySet(b *testing.B) {
+	benchRemoveUpdate(b, func() SystemAddByInterfacer { return &setSystemOneTwo{} })
+}
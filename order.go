@@ -0,0 +1,196 @@
+package ecs
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CycleError is returned when the ordering constraints of systems contradict
+// each other.
+type CycleError struct {
+	// Systems are the systems forming the cycle, each of which must be updated
+	// before the next one, and the last one before the first one.
+	Systems []System
+}
+
+func (e *CycleError) Error() string {
+	names := make([]string, 0, len(e.Systems)+1)
+	for _, sys := range e.Systems {
+		names = append(names, systemName(sys))
+	}
+	if len(e.Systems) > 0 {
+		names = append(names, systemName(e.Systems[0]))
+	}
+	return "ecs: ordering constraints of systems form a cycle: " + strings.Join(names, " -> ")
+}
+
+// systemName describes a System by its type, and label if it has one.
+func systemName(sys System) string {
+	name := fmt.Sprintf("%T", sys)
+	if l, ok := sys.(Labeler); ok {
+		name += fmt.Sprintf("(%q)", l.Label())
+	}
+	return name
+}
+
+// priority returns the priority of the System, or 0 if it has none.
+func priority(sys System) int {
+	if p, ok := sys.(Prioritizer); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// sameSystem reports whether a and b are the same System, without panicking on
+// systems of uncomparable types.
+func sameSystem(a, b interface{}) bool {
+	typ := reflect.TypeOf(a)
+	if typ != reflect.TypeOf(b) || typ != nil && !typ.Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// orderSystems sorts the systems so that every ordering constraint is met, and
+// returns their positions in the sorted order. The systems not constrained
+// relative to each other are sorted by priority, and keep their current order
+// if that is equal.
+func orderSystems(list systems) ([]int, error) {
+	constrained := false
+	for _, sys := range list {
+		if _, ok := sys.(Dependencies); ok {
+			constrained = true
+			break
+		}
+	}
+	if !constrained {
+		order := make([]int, len(list))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return list.Less(order[i], order[j])
+		})
+		return order, nil
+	}
+
+	next := dependencyEdges(list)
+	indegree := make([]int, len(list))
+	for _, to := range next {
+		for _, j := range to {
+			indegree[j]++
+		}
+	}
+
+	// Repeatedly take the ready system with the highest priority.
+	ordered := make([]int, 0, len(list))
+	done := make([]bool, len(list))
+	for len(ordered) < len(list) {
+		best := -1
+		for i, sys := range list {
+			if done[i] || indegree[i] > 0 {
+				continue
+			}
+			if best < 0 || priority(sys) > priority(list[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil, &CycleError{findCycle(list, next, done)}
+		}
+
+		done[best] = true
+		ordered = append(ordered, best)
+		for _, j := range next[best] {
+			indegree[j]--
+		}
+	}
+	return ordered, nil
+}
+
+// dependencyEdges resolves the ordering constraints of the systems, and returns
+// for every system the positions of the systems which must run after it.
+func dependencyEdges(list systems) [][]int {
+	// resolve returns the positions of the systems a reference refers to.
+	resolve := func(ref interface{}) []int {
+		var out []int
+		for i, sys := range list {
+			if label, ok := ref.(string); ok {
+				if l, ok := sys.(Labeler); ok && l.Label() == label {
+					out = append(out, i)
+				}
+			} else if sameSystem(sys, ref) {
+				out = append(out, i)
+			}
+		}
+		return out
+	}
+
+	next := make([][]int, len(list))
+	edge := func(from, to int) {
+		if from != to {
+			next[from] = append(next[from], to)
+		}
+	}
+	for i, sys := range list {
+		deps, ok := sys.(Dependencies)
+		if !ok {
+			continue
+		}
+		for _, ref := range deps.Before() {
+			for _, j := range resolve(ref) {
+				edge(i, j)
+			}
+		}
+		for _, ref := range deps.After() {
+			for _, j := range resolve(ref) {
+				edge(j, i)
+			}
+		}
+	}
+	return next
+}
+
+// findCycle returns a cycle among the systems not done yet, all of which are
+// part of or behind a cycle.
+func findCycle(list systems, next [][]int, done []bool) []System {
+	// Walk backwards along unfinished edges from any unfinished system; since
+	// every unfinished system has an unfinished predecessor, the walk must
+	// eventually revisit a system.
+	prev := make([][]int, len(list))
+	for i := range next {
+		for _, j := range next[i] {
+			if !done[i] && !done[j] {
+				prev[j] = append(prev[j], i)
+			}
+		}
+	}
+
+	start := -1
+	for i := range list {
+		if !done[i] {
+			start = i
+			break
+		}
+	}
+
+	seen := make(map[int]int)
+	var path []int
+	for at := start; ; at = prev[at][0] {
+		if pos, ok := seen[at]; ok {
+			path = path[pos:]
+			break
+		}
+		seen[at] = len(path)
+		path = append(path, at)
+	}
+
+	// path lists the cycle backwards.
+	cycle := make([]System, len(path))
+	for i, at := range path {
+		cycle[len(path)-1-i] = list[at]
+	}
+	return cycle
+}
@@ -0,0 +1,154 @@
+package ecs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// orderedSystem is a System with a label, ordering constraints and a priority,
+// which records when it is updated.
+type orderedSystem struct {
+	label         string
+	before, after []interface{}
+	priority      int
+	log           *[]string
+}
+
+func (s *orderedSystem) Label() string         { return s.label }
+func (s *orderedSystem) Before() []interface{} { return s.before }
+func (s *orderedSystem) After() []interface{}  { return s.after }
+func (s *orderedSystem) Priority() int         { return s.priority }
+func (s *orderedSystem) Remove(BasicEntity)    {}
+func (s *orderedSystem) Update(dt float32)     { *s.log = append(*s.log, s.label) }
+
+func TestSystemOrdering(t *testing.T) {
+	var log []string
+	w := &World{}
+	input := &orderedSystem{label: "input", log: &log}
+	physics := &orderedSystem{label: "physics", after: []interface{}{input}, log: &log}
+	render := &orderedSystem{label: "render", after: []interface{}{"physics", "missing"}, priority: 100, log: &log}
+	audio := &orderedSystem{label: "audio", before: []interface{}{"input"}, priority: -5, log: &log}
+	w.AddSystem(render)
+	w.AddSystem(physics)
+	w.AddSystem(input)
+	w.AddSystem(audio)
+
+	w.Update(1)
+	assert.Equal(t, []string{"audio", "input", "physics", "render"}, log, "ordering constraints were not met")
+}
+
+// TestSystemOrderingPriority makes sure priority breaks ties between systems
+// without constraints between them
+func TestSystemOrderingPriority(t *testing.T) {
+	var log []string
+	w := &World{}
+	w.AddSystem(&orderedSystem{label: "low", log: &log})
+	w.AddSystem(&orderedSystem{label: "high", priority: 10, log: &log})
+	w.AddSystem(&orderedSystem{label: "last", after: []interface{}{"low"}, priority: 20, log: &log})
+	w.AddSystem(&orderedSystem{label: "same", log: &log})
+	w.AddSystem(&priorityChangeSystem{Rank: 500})
+
+	w.Update(1)
+	assert.Equal(t, []string{"high", "low", "last", "same"}, log)
+	assert.IsType(t, &priorityChangeSystem{}, w.Systems()[0], "priority was ignored for systems without constraints")
+}
+
+func TestSystemOrderingCycle(t *testing.T) {
+	var log []string
+	w := &World{}
+	a := &orderedSystem{label: "a", log: &log}
+	b := &orderedSystem{label: "b", after: []interface{}{"a"}, log: &log}
+	w.AddSystem(a)
+	w.AddSystem(b)
+	w.AddSystem(&orderedSystem{label: "unrelated", log: &log})
+
+	c := &orderedSystem{label: "c", after: []interface{}{b}, before: []interface{}{a}, log: &log}
+	defer func() {
+		r := recover()
+		err, ok := r.(error)
+		assert.True(t, ok, "AddSystem did not panic with an error")
+		var cycle *CycleError
+		assert.True(t, errors.As(err, &cycle))
+		assert.Len(t, cycle.Systems, 3)
+		assert.True(t, strings.Contains(err.Error(), `"a"`), err.Error())
+		assert.Len(t, w.Systems(), 3, "the system causing the cycle was added")
+	}()
+	w.AddSystem(c)
+}
+
+func TestSystemOrderingSelf(t *testing.T) {
+	var log []string
+	w := &World{}
+	s := &orderedSystem{label: "self", log: &log}
+	s.after = []interface{}{s, "self"}
+	assert.NotPanics(t, func() { w.AddSystem(s) }, "a system referring to itself formed a cycle")
+}
+
+// initOrderedSystem is an orderedSystem counting how often it was initialized
+// and finalized, which calls init when initialized.
+type initOrderedSystem struct {
+	orderedSystem
+	init                   func(*World)
+	initialized, finalized int
+}
+
+func (s *initOrderedSystem) New(w *World) {
+	s.initialized++
+	if s.init != nil {
+		s.init(w)
+	}
+}
+
+func (s *initOrderedSystem) Finalize(*World) error {
+	s.finalized++
+	return nil
+}
+
+func TestTryAddSystem(t *testing.T) {
+	var log []string
+	w := &World{}
+	a := &orderedSystem{label: "a", log: &log}
+	b := &orderedSystem{label: "b", after: []interface{}{"a"}, log: &log}
+	assert.NoError(t, w.TryAddSystem(a))
+	assert.NoError(t, w.TryAddSystem(b))
+
+	c := &initOrderedSystem{orderedSystem: orderedSystem{label: "c", after: []interface{}{b}, before: []interface{}{a}, log: &log}}
+	var cycle *CycleError
+	assert.True(t, errors.As(w.TryAddSystem(c), &cycle))
+	assert.Len(t, cycle.Systems, 3)
+	assert.Len(t, w.Systems(), 2, "the system causing the cycle was added")
+	assert.Equal(t, 0, c.initialized, "the system causing the cycle was initialized")
+
+	err := w.TryAddSystem(c, InStage("Missing"))
+	assert.True(t, errors.Is(err, ErrUnknownStage), err)
+	assert.Len(t, w.Systems(), 2)
+
+	// Constraints on systems of other stages are ignored.
+	assert.NoError(t, w.TryAddSystem(c, InStage(StageRender)))
+	assert.Equal(t, 1, c.initialized)
+	w.Update(1)
+	assert.Equal(t, []string{"a", "b", "c"}, log)
+
+	w.Close()
+	assert.Equal(t, ErrClosed, w.TryAddSystem(&orderedSystem{log: &log}))
+}
+
+// TestTryAddSystemInitCycle makes sure a System whose initialization adds
+// systems forming a cycle with it is finalized
+func TestTryAddSystemInitCycle(t *testing.T) {
+	var log []string
+	w := &World{}
+	d := &initOrderedSystem{orderedSystem: orderedSystem{label: "d", after: []interface{}{"e"}, log: &log}}
+	d.init = func(w *World) {
+		w.AddSystem(&orderedSystem{label: "e", after: []interface{}{d}, log: &log})
+	}
+
+	var cycle *CycleError
+	assert.True(t, errors.As(w.TryAddSystem(d), &cycle))
+	assert.Len(t, w.Systems(), 1, "the system causing the cycle was added")
+	assert.Equal(t, 1, d.initialized)
+	assert.Equal(t, 1, d.finalized, "the initialized system was not finalized")
+}
@@ -0,0 +1,596 @@
+package ecs
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// filterKind is the way a Filter restricts a query.
+type filterKind int
+
+const (
+	filterWith filterKind = iota
+	filterWithout
+	filterOptional
+	filterAdded
+	filterChanged
+)
+
+// A Filter restricts the entities matched by a query, by a component type other
+// than the ones the query returns.
+type Filter struct {
+	kind filterKind
+	// component resolves the component type on the World of the query.
+	component func(*World) *componentType
+}
+
+// With matches only entities having a component of type T, without returning
+// it.
+func With[T any]() Filter {
+	return Filter{filterWith, componentTypeOf[T]}
+}
+
+// Without matches only entities not having a component of type T.
+func Without[T any]() Filter {
+	return Filter{filterWithout, componentTypeOf[T]}
+}
+
+// Optional matches entities whether or not they have a component of type T,
+// which must be one of the types returned by the query. If an entity does not
+// have one, nil is passed in its place.
+func Optional[T any]() Filter {
+	return Filter{filterOptional, componentTypeOf[T]}
+}
+
+// query is the part of a typed query independent of the component types.
+type query struct {
+	w *World
+	// types are the component types returned by the query, and optional
+	// whether each of them may be missing.
+	types    []*componentType
+	optional []bool
+
+	state *queryState
+
+	// changes are the Added and Changed filters, which are checked during
+	// iteration against the tick since which changes are reported.
+	changes []changeFilter
+	since   uint64
+}
+
+func newQuery(w *World, types []*componentType, filters []Filter) query {
+	q := query{
+		w:        w,
+		types:    types,
+		optional: make([]bool, len(types)),
+	}
+
+	var required, excluded []*componentType
+	for _, f := range filters {
+		ct := f.component(w)
+		switch f.kind {
+		case filterWith:
+			required = append(required, ct)
+		case filterWithout:
+			excluded = append(excluded, ct)
+		case filterAdded, filterChanged:
+			required = append(required, ct)
+			q.changes = append(q.changes, changeFilter{ct, f.kind == filterAdded})
+		case filterOptional:
+			found := false
+			for i, t := range types {
+				if t == ct {
+					q.optional[i] = true
+					found = true
+				}
+			}
+			if !found {
+				panic("ecs: Optional filter for " + ct.typ.String() + ", which the query does not return")
+			}
+		}
+	}
+	for i, t := range types {
+		if !q.optional[i] {
+			required = append(required, t)
+		}
+	}
+	if len(required) == 0 {
+		panic("ecs: a query needs at least one component type that is not optional")
+	}
+
+	q.state = w.queryState(required, excluded)
+	return q
+}
+
+// accept reports whether the entity with the given ID passes the Added and
+// Changed filters of the query.
+func (q *query) accept(id uint64) bool {
+	for _, f := range q.changes {
+		t, ok := f.ct.ticks.Get(id)
+		if !ok {
+			return false
+		}
+		tick := t.changed
+		if f.added {
+			tick = t.added
+		}
+		if tick < q.since {
+			return false
+		}
+	}
+	return true
+}
+
+// done is called after iterating over the query. Changes from now on are
+// reported by the next iteration, even those made during the current tick, so
+// the tick is moved on.
+func (q *query) done() {
+	q.since = q.w.nextTick()
+}
+
+// eachSparse calls fn with the ID of every matching entity in SparseStorage
+// mode.
+func (q *query) eachSparse(fn func(id uint64)) {
+	for _, id := range q.state.entities.dense {
+		if q.changes == nil || q.accept(id) {
+			fn(id)
+		}
+	}
+	q.done()
+}
+
+// eachArchetype calls fn with every matching archetype in ArchetypeStorage
+// mode. fn must check the Added and Changed filters itself.
+func (q *query) eachArchetype(fn func(a *archetype)) {
+	for _, a := range q.state.archetypes {
+		fn(a)
+	}
+	q.done()
+}
+
+// SetParWorkers sets the number of goroutines ParEach processes batches of
+// entities with. The default of 0 uses runtime.GOMAXPROCS goroutines. It is
+// independent of SetWorkers, which sets how many systems are updated at the same
+// time.
+func (w *World) SetParWorkers(n int) {
+	w.parWorkers = n
+}
+
+// ParWorkers returns the number of goroutines ParEach processes batches of
+// entities with.
+func (w *World) ParWorkers() int {
+	if w.parWorkers < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return w.parWorkers
+}
+
+// parallel splits the matching entities into batches of at most batchSize
+// entities, which are processed by up to ParWorkers goroutines at the same time.
+// In SparseStorage mode sparse is called with the IDs of every batch, and in
+// ArchetypeStorage mode arch with the rows of every batch. The World panics on
+// structural changes until every batch is done.
+func (q *query) parallel(batchSize int, sparse func(ids []uint64), arch func(a *archetype, start, end int)) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	type batch struct {
+		a          *archetype
+		start, end int
+	}
+	var batches []batch
+	split := func(a *archetype, n int) {
+		for start := 0; start < n; start += batchSize {
+			end := start + batchSize
+			if end > n {
+				end = n
+			}
+			batches = append(batches, batch{a, start, end})
+		}
+	}
+	ids := q.state.entities.dense
+	if q.w.storageMode == ArchetypeStorage {
+		for _, a := range q.state.archetypes {
+			split(a, len(a.ids))
+		}
+	} else {
+		split(nil, len(ids))
+	}
+
+	// A panic in any batch, like one caused by a structural change, stops the
+	// other batches and is raised again once every worker is done, so that the
+	// World stays guarded for as long as fn runs anywhere.
+	var (
+		mu        sync.Mutex
+		panicked  bool
+		recovered interface{}
+	)
+	next := int64(-1)
+	work := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				mu.Lock()
+				if !panicked {
+					panicked, recovered = true, r
+				}
+				mu.Unlock()
+				atomic.StoreInt64(&next, int64(len(batches)))
+			}
+		}()
+		for {
+			i := int(atomic.AddInt64(&next, 1))
+			if i >= len(batches) {
+				return
+			}
+			b := batches[i]
+			if b.a != nil {
+				arch(b.a, b.start, b.end)
+			} else {
+				sparse(ids[b.start:b.end])
+			}
+		}
+	}
+
+	atomic.AddInt32(&q.w.iterating, 1)
+	workers := q.w.ParWorkers()
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	var wg sync.WaitGroup
+	for i := 1; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work()
+		}()
+	}
+	work()
+	wg.Wait()
+	atomic.AddInt32(&q.w.iterating, -1)
+
+	if panicked {
+		panic(recovered)
+	}
+	q.done()
+}
+
+// Count returns the number of entities matching the query, disregarding any
+// Added and Changed filters.
+func (q *query) Count() int {
+	if q.w.storageMode == ArchetypeStorage {
+		n := 0
+		for _, a := range q.state.archetypes {
+			n += len(a.ids)
+		}
+		return n
+	}
+	return q.state.entities.len()
+}
+
+// columnData returns the components in the column of the archetype for the
+// given type, or nil if it has none.
+func columnData[T any](a *archetype, ct *componentType) []T {
+	if c := a.column(ct); c != nil {
+		return c.(*typedColumn[T]).data
+	}
+	return nil
+}
+
+// at returns a pointer to the component at the given row, or nil if data is
+// nil.
+func at[T any](data []T, row int) *T {
+	if data == nil {
+		return nil
+	}
+	return &data[row]
+}
+
+// Query1 iterates over all entities having a component of type A. It is a
+// statically typed alternative to systems adding entities by interface.
+type Query1[A any] struct {
+	query
+}
+
+// NewQuery1 creates a query over the entities of the World having a component
+// of type A, restricted further by the given filters.
+func NewQuery1[A any](w *World, filters ...Filter) *Query1[A] {
+	return &Query1[A]{newQuery(w, []*componentType{componentTypeOf[A](w)}, filters)}
+}
+
+// Each calls fn for every matching entity, with its ID and components. fn must
+// not add or remove components or entities. Added and Changed filters report
+// the changes since the previous call to Each.
+func (q *Query1[A]) Each(fn func(id uint64, a *A)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.eachArchetype(func(arch *archetype) {
+			ca := columnData[A](arch, q.types[0])
+			for row, id := range arch.ids {
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	q.eachSparse(func(id uint64) {
+		a, _ := sa.Get(id)
+		fn(id, a)
+	})
+}
+
+// ParEach calls fn for every matching entity like Each, but splits the entities
+// into batches of at most batchSize, which are processed by up to ParWorkers
+// goroutines at the same time. fn must be safe for concurrent use, and the World
+// panics on structural changes until ParEach returns; record them in the
+// Commands of the World instead.
+func (q *Query1[A]) ParEach(batchSize int, fn func(id uint64, a *A)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.parallel(batchSize, nil, func(arch *archetype, start, end int) {
+			ca := columnData[A](arch, q.types[0])
+			for row := start; row < end; row++ {
+				id := arch.ids[row]
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	q.parallel(batchSize, func(ids []uint64) {
+		for _, id := range ids {
+			if q.changes != nil && !q.accept(id) {
+				continue
+			}
+			a, _ := sa.Get(id)
+			fn(id, a)
+		}
+	}, nil)
+}
+
+// Query2 iterates over all entities having components of types A and B. It is a
+// statically typed alternative to systems adding entities by interface.
+type Query2[A, B any] struct {
+	query
+}
+
+// NewQuery2 creates a query over the entities of the World having components of
+// types A and B, restricted further by the given filters.
+func NewQuery2[A, B any](w *World, filters ...Filter) *Query2[A, B] {
+	return &Query2[A, B]{newQuery(w, []*componentType{componentTypeOf[A](w), componentTypeOf[B](w)}, filters)}
+}
+
+// Each calls fn for every matching entity, with its ID and components. fn must
+// not add or remove components or entities. Added and Changed filters report
+// the changes since the previous call to Each.
+func (q *Query2[A, B]) Each(fn func(id uint64, a *A, b *B)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.eachArchetype(func(arch *archetype) {
+			ca := columnData[A](arch, q.types[0])
+			cb := columnData[B](arch, q.types[1])
+			for row, id := range arch.ids {
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row), at(cb, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	sb := q.types[1].storage.(*Storage[B])
+	q.eachSparse(func(id uint64) {
+		a, _ := sa.Get(id)
+		b, _ := sb.Get(id)
+		fn(id, a, b)
+	})
+}
+
+// ParEach calls fn for every matching entity like Each, but splits the entities
+// into batches of at most batchSize, which are processed by up to ParWorkers
+// goroutines at the same time. fn must be safe for concurrent use, and the World
+// panics on structural changes until ParEach returns; record them in the
+// Commands of the World instead.
+func (q *Query2[A, B]) ParEach(batchSize int, fn func(id uint64, a *A, b *B)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.parallel(batchSize, nil, func(arch *archetype, start, end int) {
+			ca := columnData[A](arch, q.types[0])
+			cb := columnData[B](arch, q.types[1])
+			for row := start; row < end; row++ {
+				id := arch.ids[row]
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row), at(cb, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	sb := q.types[1].storage.(*Storage[B])
+	q.parallel(batchSize, func(ids []uint64) {
+		for _, id := range ids {
+			if q.changes != nil && !q.accept(id) {
+				continue
+			}
+			a, _ := sa.Get(id)
+			b, _ := sb.Get(id)
+			fn(id, a, b)
+		}
+	}, nil)
+}
+
+// Query3 iterates over all entities having components of types A, B and C. It
+// is a statically typed alternative to systems adding entities by interface.
+type Query3[A, B, C any] struct {
+	query
+}
+
+// NewQuery3 creates a query over the entities of the World having components of
+// types A, B and C, restricted further by the given filters.
+func NewQuery3[A, B, C any](w *World, filters ...Filter) *Query3[A, B, C] {
+	return &Query3[A, B, C]{newQuery(w, []*componentType{componentTypeOf[A](w), componentTypeOf[B](w), componentTypeOf[C](w)}, filters)}
+}
+
+// Each calls fn for every matching entity, with its ID and components. fn must
+// not add or remove components or entities. Added and Changed filters report
+// the changes since the previous call to Each.
+func (q *Query3[A, B, C]) Each(fn func(id uint64, a *A, b *B, c *C)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.eachArchetype(func(arch *archetype) {
+			ca := columnData[A](arch, q.types[0])
+			cb := columnData[B](arch, q.types[1])
+			cc := columnData[C](arch, q.types[2])
+			for row, id := range arch.ids {
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row), at(cb, row), at(cc, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	sb := q.types[1].storage.(*Storage[B])
+	sc := q.types[2].storage.(*Storage[C])
+	q.eachSparse(func(id uint64) {
+		a, _ := sa.Get(id)
+		b, _ := sb.Get(id)
+		c, _ := sc.Get(id)
+		fn(id, a, b, c)
+	})
+}
+
+// ParEach calls fn for every matching entity like Each, but splits the entities
+// into batches of at most batchSize, which are processed by up to ParWorkers
+// goroutines at the same time. fn must be safe for concurrent use, and the World
+// panics on structural changes until ParEach returns; record them in the
+// Commands of the World instead.
+func (q *Query3[A, B, C]) ParEach(batchSize int, fn func(id uint64, a *A, b *B, c *C)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.parallel(batchSize, nil, func(arch *archetype, start, end int) {
+			ca := columnData[A](arch, q.types[0])
+			cb := columnData[B](arch, q.types[1])
+			cc := columnData[C](arch, q.types[2])
+			for row := start; row < end; row++ {
+				id := arch.ids[row]
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row), at(cb, row), at(cc, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	sb := q.types[1].storage.(*Storage[B])
+	sc := q.types[2].storage.(*Storage[C])
+	q.parallel(batchSize, func(ids []uint64) {
+		for _, id := range ids {
+			if q.changes != nil && !q.accept(id) {
+				continue
+			}
+			a, _ := sa.Get(id)
+			b, _ := sb.Get(id)
+			c, _ := sc.Get(id)
+			fn(id, a, b, c)
+		}
+	}, nil)
+}
+
+// Query4 iterates over all entities having components of types A, B, C and D.
+// It is a statically typed alternative to systems adding entities by interface.
+type Query4[A, B, C, D any] struct {
+	query
+}
+
+// NewQuery4 creates a query over the entities of the World having components of
+// types A, B, C and D, restricted further by the given filters.
+func NewQuery4[A, B, C, D any](w *World, filters ...Filter) *Query4[A, B, C, D] {
+	return &Query4[A, B, C, D]{newQuery(w, []*componentType{componentTypeOf[A](w), componentTypeOf[B](w), componentTypeOf[C](w), componentTypeOf[D](w)}, filters)}
+}
+
+// Each calls fn for every matching entity, with its ID and components. fn must
+// not add or remove components or entities. Added and Changed filters report
+// the changes since the previous call to Each.
+func (q *Query4[A, B, C, D]) Each(fn func(id uint64, a *A, b *B, c *C, d *D)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.eachArchetype(func(arch *archetype) {
+			ca := columnData[A](arch, q.types[0])
+			cb := columnData[B](arch, q.types[1])
+			cc := columnData[C](arch, q.types[2])
+			cd := columnData[D](arch, q.types[3])
+			for row, id := range arch.ids {
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row), at(cb, row), at(cc, row), at(cd, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	sb := q.types[1].storage.(*Storage[B])
+	sc := q.types[2].storage.(*Storage[C])
+	sd := q.types[3].storage.(*Storage[D])
+	q.eachSparse(func(id uint64) {
+		a, _ := sa.Get(id)
+		b, _ := sb.Get(id)
+		c, _ := sc.Get(id)
+		d, _ := sd.Get(id)
+		fn(id, a, b, c, d)
+	})
+}
+
+// ParEach calls fn for every matching entity like Each, but splits the entities
+// into batches of at most batchSize, which are processed by up to ParWorkers
+// goroutines at the same time. fn must be safe for concurrent use, and the World
+// panics on structural changes until ParEach returns; record them in the
+// Commands of the World instead.
+func (q *Query4[A, B, C, D]) ParEach(batchSize int, fn func(id uint64, a *A, b *B, c *C, d *D)) {
+	if q.w.storageMode == ArchetypeStorage {
+		q.parallel(batchSize, nil, func(arch *archetype, start, end int) {
+			ca := columnData[A](arch, q.types[0])
+			cb := columnData[B](arch, q.types[1])
+			cc := columnData[C](arch, q.types[2])
+			cd := columnData[D](arch, q.types[3])
+			for row := start; row < end; row++ {
+				id := arch.ids[row]
+				if q.changes != nil && !q.accept(id) {
+					continue
+				}
+				fn(id, at(ca, row), at(cb, row), at(cc, row), at(cd, row))
+			}
+		})
+		return
+	}
+
+	sa := q.types[0].storage.(*Storage[A])
+	sb := q.types[1].storage.(*Storage[B])
+	sc := q.types[2].storage.(*Storage[C])
+	sd := q.types[3].storage.(*Storage[D])
+	q.parallel(batchSize, func(ids []uint64) {
+		for _, id := range ids {
+			if q.changes != nil && !q.accept(id) {
+				continue
+			}
+			a, _ := sa.Get(id)
+			b, _ := sb.Get(id)
+			c, _ := sc.Get(id)
+			d, _ := sd.Get(id)
+			fn(id, a, b, c, d)
+		}
+	}, nil)
+}
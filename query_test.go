@@ -0,0 +1,337 @@
+package ecs
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type frozen struct{}
+
+type health struct {
+	HP int
+}
+
+type mass struct {
+	M float32
+}
+
+func TestQuery(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			es := w.NewEntities(4)
+			for _, e := range es {
+				AddComponent(w, e.ID(), position{})
+			}
+			AddComponent(w, es[0].ID(), velocity{X: 1})
+			AddComponent(w, es[1].ID(), velocity{X: 2})
+			AddComponent(w, es[1].ID(), frozen{})
+			AddComponent(w, es[2].ID(), velocity{X: 3})
+			AddComponent(w, es[2].ID(), health{HP: 10})
+
+			q := NewQuery2[position, velocity](w)
+			assert.Equal(t, 3, q.Count())
+			q.Each(func(id uint64, p *position, v *velocity) {
+				p.X += v.X
+			})
+			for i, want := range []float32{1, 2, 3, 0} {
+				p, _ := GetComponent[position](w, es[i].ID())
+				assert.Equal(t, want, p.X, "entity %d was not moved correctly", i)
+			}
+
+			var seen []uint64
+			NewQuery2[position, velocity](w, Without[frozen]()).Each(func(id uint64, p *position, v *velocity) {
+				seen = append(seen, id)
+			})
+			assert.ElementsMatch(t, []uint64{es[0].ID(), es[2].ID()}, seen, "Without did not exclude frozen entities")
+
+			seen = nil
+			NewQuery1[position](w, With[health]()).Each(func(id uint64, p *position) {
+				seen = append(seen, id)
+			})
+			assert.Equal(t, []uint64{es[2].ID()}, seen, "With did not restrict the query")
+
+			missing := 0
+			NewQuery2[position, velocity](w, Optional[velocity]()).Each(func(id uint64, p *position, v *velocity) {
+				if v == nil {
+					missing++
+				}
+			})
+			assert.Equal(t, 1, missing, "Optional did not pass nil for entities without the component")
+			assert.Equal(t, 4, NewQuery2[position, velocity](w, Optional[velocity]()).Count())
+		})
+	}
+}
+
+func TestQueryMore(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			e := w.NewEntity()
+			AddComponent(w, e.ID(), position{})
+			AddComponent(w, e.ID(), velocity{X: 1})
+			AddComponent(w, e.ID(), health{HP: 1})
+			AddComponent(w, e.ID(), mass{M: 1})
+
+			calls := 0
+			NewQuery3[position, velocity, health](w).Each(func(id uint64, p *position, v *velocity, h *health) {
+				calls++
+				h.HP++
+			})
+			NewQuery4[position, velocity, health, mass](w).Each(func(id uint64, p *position, v *velocity, h *health, m *mass) {
+				calls++
+				h.HP++
+			})
+			assert.Equal(t, 2, calls)
+			h, _ := GetComponent[health](w, e.ID())
+			assert.Equal(t, 3, h.HP)
+		})
+	}
+}
+
+func TestQueryInvalidFilters(t *testing.T) {
+	w := &World{}
+	assert.Panics(t, func() { NewQuery1[position](w, Optional[velocity]()) }, "Optional accepted a type the query does not return")
+	assert.Panics(t, func() { NewQuery1[position](w, Optional[position]()) }, "a query without required components was created")
+}
+
+// TestQueryCached makes sure queries declared before entities change stay up to
+// date
+func TestQueryCached(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			q := NewQuery2[position, velocity](w, Without[frozen]())
+			assert.Same(t, q.state, NewQuery2[velocity, position](w, Without[frozen]()).state, "equal queries do not share their state")
+			assert.NotSame(t, q.state, NewQuery2[position, velocity](w).state)
+			assert.Equal(t, 0, q.Count())
+
+			es := w.NewEntities(3)
+			for _, e := range es {
+				AddComponent(w, e.ID(), position{})
+				AddComponent(w, e.ID(), velocity{})
+			}
+			assert.Equal(t, 3, q.Count(), "adding components did not update the query")
+
+			AddComponent(w, es[0].ID(), frozen{})
+			assert.Equal(t, 2, q.Count(), "adding an excluded component did not update the query")
+
+			RemoveComponent[velocity](w, es[1].ID())
+			assert.Equal(t, 1, q.Count(), "removing a component did not update the query")
+
+			w.RemoveEntity(es[2])
+			assert.Equal(t, 0, q.Count(), "removing an entity did not update the query")
+
+			RemoveComponent[frozen](w, es[0].ID())
+			var seen []uint64
+			q.Each(func(id uint64, p *position, v *velocity) {
+				seen = append(seen, id)
+			})
+			assert.Equal(t, []uint64{es[0].ID()}, seen, "removing an excluded component did not update the query")
+		})
+	}
+}
+
+// benchQueryChanges changes a single entity per frame and iterates over a query
+// matching only a handful of entities, so the cost per frame should not depend
+// on the total number of entities.
+func benchQueryChanges(b *testing.B, mode StorageMode, entities int) {
+	w := &World{}
+	w.SetStorageMode(mode)
+	w.SetAllocator(&IDAllocator{})
+	es := w.NewEntities(entities)
+	for i, e := range es {
+		AddComponent(w, e.ID(), position{})
+		if i < 10 {
+			AddComponent(w, e.ID(), velocity{})
+		}
+	}
+	q := NewQuery2[position, velocity](w)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		id := es[10+i%10].ID()
+		if HasComponent[velocity](w, id) {
+			RemoveComponent[velocity](w, id)
+		} else {
+			AddComponent(w, id, velocity{})
+		}
+		q.Each(func(id uint64, p *position, v *velocity) {
+			p.X += v.X
+		})
+	}
+}
+
+func BenchmarkQueryChanges10000Entities(b *testing.B) {
+	benchQueryChanges(b, SparseStorage, 10000)
+}
+
+func BenchmarkQueryChanges100000Entities(b *testing.B) {
+	benchQueryChanges(b, SparseStorage, 100000)
+}
+
+func BenchmarkQueryChangesArchetype10000Entities(b *testing.B) {
+	benchQueryChanges(b, ArchetypeStorage, 10000)
+}
+
+func BenchmarkQueryChangesArchetype100000Entities(b *testing.B) {
+	benchQueryChanges(b, ArchetypeStorage, 100000)
+}
+
+func TestQueryParEach(t *testing.T) {
+	for _, tt := range storageModes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &World{}
+			w.SetStorageMode(tt.mode)
+			w.SetParWorkers(4)
+			es := w.NewEntities(1000)
+			for i, e := range es {
+				AddComponent(w, e.ID(), position{})
+				AddComponent(w, e.ID(), velocity{X: 1})
+				if i%3 == 0 {
+					// Spread the entities over several archetypes.
+					AddComponent(w, e.ID(), health{})
+				}
+			}
+
+			var calls int64
+			NewQuery2[position, velocity](w).ParEach(7, func(id uint64, p *position, v *velocity) {
+				atomic.AddInt64(&calls, 1)
+				p.X += v.X
+			})
+			assert.Equal(t, int64(len(es)), calls)
+			for _, e := range es {
+				p, _ := GetComponent[position](w, e.ID())
+				assert.Equal(t, float32(1), p.X, "an entity was not processed exactly once")
+			}
+
+			calls = 0
+			NewQuery3[position, velocity, health](w).ParEach(0, func(id uint64, p *position, v *velocity, h *health) {
+				atomic.AddInt64(&calls, 1)
+			})
+			assert.Equal(t, int64(334), calls)
+		})
+	}
+}
+
+// TestQueryParWorkers makes sure ParEach does not depend on the number of
+// systems updated in parallel
+func TestQueryParWorkers(t *testing.T) {
+	w := &World{}
+	assert.Equal(t, runtime.GOMAXPROCS(0), w.ParWorkers())
+	w.SetWorkers(1)
+	w.SetParWorkers(2)
+	assert.Equal(t, 2, w.ParWorkers())
+	assert.Equal(t, 1, w.Workers())
+
+	for _, e := range w.NewEntities(2) {
+		AddComponent(w, e.ID(), position{})
+	}
+	// Both batches wait for each other, which only finishes if they are
+	// processed in parallel.
+	var arrived int32
+	NewQuery1[position](w).ParEach(1, func(id uint64, p *position) {
+		atomic.AddInt32(&arrived, 1)
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&arrived) < 2 && time.Now().Before(deadline) {
+			runtime.Gosched()
+		}
+		p.X++
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&arrived))
+}
+
+// TestQueryParEachStructural makes sure structural changes are refused while a
+// query is iterated over in parallel
+func TestQueryParEachStructural(t *testing.T) {
+	w := &World{}
+	e := w.NewEntity()
+	AddComponent(w, e.ID(), position{})
+	q := NewQuery1[position](w)
+
+	assert.Panics(t, func() {
+		q.ParEach(1, func(id uint64, p *position) {
+			AddComponent(w, id, velocity{})
+		})
+	})
+	assert.Panics(t, func() {
+		q.ParEach(1, func(id uint64, p *position) {
+			w.RemoveEntity(e)
+		})
+	})
+	assert.False(t, HasComponent[velocity](w, e.ID()))
+
+	q.ParEach(1, func(id uint64, p *position) {
+		DeferAddComponent(w.Commands(), id, velocity{})
+	})
+	AddComponent(w, e.ID(), health{})
+	w.FlushCommands()
+	assert.True(t, HasComponent[velocity](w, e.ID()), "structural changes were still refused after ParEach")
+}
+
+// TestQueryParEachStructuralWorkers makes sure a structural change on any worker
+// panics on the calling goroutine, and that the World stays guarded until every
+// worker is done
+func TestQueryParEachStructuralWorkers(t *testing.T) {
+	w := &World{}
+	w.SetParWorkers(4)
+	es := w.NewEntities(100)
+	for _, e := range es {
+		AddComponent(w, e.ID(), position{})
+	}
+	q := NewQuery1[position](w)
+
+	for i := 0; i < 10; i++ {
+		assert.Panics(t, func() {
+			q.ParEach(1, func(id uint64, p *position) {
+				time.Sleep(time.Millisecond)
+				AddComponent(w, id, velocity{})
+			})
+		})
+		assert.Zero(t, atomic.LoadInt32(&w.iterating))
+	}
+	for _, e := range es {
+		assert.False(t, HasComponent[velocity](w, e.ID()), "a structural change was made during ParEach")
+	}
+}
+
+func BenchmarkQueryEach(b *testing.B) {
+	w := &World{}
+	for _, e := range w.NewEntities(100000) {
+		AddComponent(w, e.ID(), position{})
+		AddComponent(w, e.ID(), velocity{X: 1})
+	}
+	q := NewQuery2[position, velocity](w)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Each(func(id uint64, p *position, v *velocity) {
+			p.X += v.X
+		})
+	}
+}
+
+func BenchmarkQueryParEach(b *testing.B) {
+	w := &World{}
+	w.SetParWorkers(runtime.GOMAXPROCS(0))
+	for _, e := range w.NewEntities(100000) {
+		AddComponent(w, e.ID(), position{})
+		AddComponent(w, e.ID(), velocity{X: 1})
+	}
+	q := NewQuery2[position, velocity](w)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.ParEach(1024, func(id uint64, p *position, v *velocity) {
+			p.X += v.X
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package ecs
+
+// queryState holds the entities matching a set of required and excluded
+// component types. The World keeps it up to date as components are added and
+// removed, so iterating over a query never needs to scan for matches. Queries
+// with the same required and excluded types share their queryState.
+type queryState struct {
+	required, excluded []*componentType
+	with, without      componentMask
+
+	// entities holds the matching entities in SparseStorage mode.
+	entities sparseSet
+	// archetypes holds the matching archetypes in ArchetypeStorage mode.
+	archetypes []*archetype
+}
+
+// queryKey identifies a queryState by its masks.
+type queryKey struct {
+	with, without string
+}
+
+// queryState returns the queryState for the given component types, creating
+// and populating it when there is none yet. It is safe for concurrent use by
+// systems updated in parallel.
+func (w *World) queryState(required, excluded []*componentType) *queryState {
+	var with, without componentMask
+	for _, ct := range required {
+		with = with.with(ct.id)
+	}
+	for _, ct := range excluded {
+		without = without.with(ct.id)
+	}
+
+	key := queryKey{with.key(), without.key()}
+	w.registry.Lock()
+	defer w.registry.Unlock()
+	if qs, ok := w.queries[key]; ok {
+		return qs
+	}
+
+	qs := &queryState{
+		required: required,
+		excluded: excluded,
+		with:     with,
+		without:  without,
+	}
+	if w.queries == nil {
+		w.queries = make(map[queryKey]*queryState)
+	}
+	w.queries[key] = qs
+	for _, ct := range required {
+		ct.queries = append(ct.queries, qs)
+	}
+	for _, ct := range excluded {
+		ct.queries = append(ct.queries, qs)
+	}
+
+	if w.storageMode == ArchetypeStorage {
+		qs.archetypes = w.archetypes.matching(with, without)
+		w.archetypes.queries = append(w.archetypes.queries, qs)
+		return qs
+	}
+
+	// Scanning the smallest Storage of a required type is enough to find every
+	// matching entity.
+	driver := required[0].storage
+	for _, ct := range required[1:] {
+		if ct.storage.Len() < driver.Len() {
+			driver = ct.storage
+		}
+	}
+	for _, id := range driver.IDs() {
+		if qs.matches(w, id) {
+			qs.entities.insert(id)
+		}
+	}
+	return qs
+}
+
+// matches reports whether the entity with the given ID matches.
+func (qs *queryState) matches(w *World, id uint64) bool {
+	for _, ct := range qs.required {
+		if !w.hasComponent(ct, id) {
+			return false
+		}
+	}
+	for _, ct := range qs.excluded {
+		if w.hasComponent(ct, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// update re-evaluates whether the entity with the given ID matches, after a
+// component of one of the types of the queryState was added or removed.
+func (qs *queryState) update(w *World, id uint64) {
+	if qs.matches(w, id) {
+		qs.entities.insert(id)
+	} else {
+		qs.entities.remove(id)
+	}
+}
+
+// addArchetype adds the archetype to the queryState if it matches.
+func (qs *queryState) addArchetype(a *archetype) {
+	if a.mask.containsAll(qs.with) && !a.mask.intersects(qs.without) {
+		qs.archetypes = append(qs.archetypes, a)
+	}
+}
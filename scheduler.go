@@ -0,0 +1,210 @@
+package ecs
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Access lists the component types a System reads and writes during Update.
+type Access struct {
+	Reads, Writes []reflect.Type
+}
+
+// TypeOf returns the type of the component type T, for use in an Access.
+func TypeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// conflicts reports whether systems with access a and b may not run at the
+// same time, because one of them writes a component type the other uses.
+func (a Access) conflicts(b Access) bool {
+	return overlaps(a.Writes, b.Reads) || overlaps(a.Writes, b.Writes) || overlaps(b.Writes, a.Reads)
+}
+
+func overlaps(a, b []reflect.Type) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetWorkers sets the number of systems the World may update at the same time.
+// With more than one worker, Update runs systems declaring non-conflicting
+// component access via Accessor in parallel, as long as their priority is the
+// same and no ordering constraints exist between them. Systems updated in
+// parallel share one tick, see Tick. The default of 1 updates every System on
+// its own.
+//
+// Systems updated in parallel must not change the World other than through
+// the components they declared to write; structural changes must be recorded
+// in the Commands returned by CommandsOf instead.
+func (w *World) SetWorkers(n int) {
+	w.workers = n
+}
+
+// Workers returns the number of systems the World may update at the same time.
+func (w *World) Workers() int {
+	if w.workers < 1 {
+		return 1
+	}
+	return w.workers
+}
+
+// systemBatches groups consecutive systems of the stage which can be updated in
+// parallel. The batches are cached until the systems change.
+func (s *stage) systemBatches() [][]System {
+	if s.batches != nil {
+		return s.batches
+	}
+
+	next := dependencyEdges(s.systems)
+	related := func(i, j int) bool {
+		for _, k := range next[i] {
+			if k == j {
+				return true
+			}
+		}
+		for _, k := range next[j] {
+			if k == i {
+				return true
+			}
+		}
+		return false
+	}
+
+	accesses := make([]*Access, len(s.systems))
+	for i, sys := range s.systems {
+		if a, ok := sys.(Accessor); ok {
+			access := a.Access()
+			accesses[i] = &access
+		}
+	}
+
+	// Systems of uncomparable types cannot be told apart from their copies, and
+	// a System added several times may not run concurrently with itself.
+	canJoin := func(i int, batch []int) bool {
+		if accesses[i] == nil || !reflect.TypeOf(s.systems[i]).Comparable() {
+			return false
+		}
+		for _, j := range batch {
+			if accesses[j] == nil ||
+				sameSystem(s.systems[i], s.systems[j]) ||
+				priority(s.systems[i]) != priority(s.systems[j]) ||
+				related(i, j) ||
+				accesses[i].conflicts(*accesses[j]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var batches [][]System
+	var batch []int
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		systems := make([]System, len(batch))
+		for k, i := range batch {
+			systems[k] = s.systems[i]
+		}
+		batches = append(batches, systems)
+		batch = nil
+	}
+	for i := range s.systems {
+		if !canJoin(i, batch) {
+			flush()
+		}
+		batch = append(batch, i)
+	}
+	flush()
+
+	s.batches = batches
+	return batches
+}
+
+// enabledSystems returns the enabled systems of the batch.
+func (w *World) enabledSystems(batch []System) []System {
+	enabled := make([]System, 0, len(batch))
+	for _, system := range batch {
+		if w.SystemEnabled(system) {
+			enabled = append(enabled, system)
+		}
+	}
+	return enabled
+}
+
+// updateParallel updates the enabled systems of the stage batch by batch, with the
+// systems of a batch updated in parallel by at most Workers goroutines.
+func (w *World) updateParallel(s *stage, dt float32) {
+	sem := make(chan struct{}, w.Workers())
+	for _, batch := range s.systemBatches() {
+		if len(w.disabled) > 0 {
+			batch = w.enabledSystems(batch)
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		w.nextTick()
+		if len(batch) == 1 {
+			batch[0].Update(dt)
+			w.FlushCommands()
+			continue
+		}
+		w.updateBatch(batch, sem, dt)
+	}
+}
+
+// updateBatch updates the systems of the batch in parallel, each recording in a
+// Commands of its own, which are applied in the order of the batch once every
+// System is done.
+func (w *World) updateBatch(batch []System, sem chan struct{}, dt float32) {
+	buffers := make([]Commands, len(batch))
+	w.batchSystems, w.batchCommands = batch, buffers
+
+	// A panic in a System is raised again on the calling goroutine once every
+	// System of the batch is done. The commands are then left to the next sync
+	// point, as they are when a System updated on its own panics.
+	var (
+		mu        sync.Mutex
+		panicked  bool
+		recovered interface{}
+	)
+	var wg sync.WaitGroup
+	for _, system := range batch {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(system System) {
+			defer func() {
+				if r := recover(); r != nil {
+					mu.Lock()
+					if !panicked {
+						panicked, recovered = true, r
+					}
+					mu.Unlock()
+				}
+				<-sem
+				wg.Done()
+			}()
+			system.Update(dt)
+		}(system)
+	}
+	wg.Wait()
+	w.batchSystems, w.batchCommands = nil, nil
+
+	if panicked {
+		for i := range buffers {
+			buffers[i].moveTo(&w.commands)
+		}
+		panic(recovered)
+	}
+	for i := range buffers {
+		buffers[i].flush(w)
+	}
+	w.FlushCommands()
+}
@@ -0,0 +1,317 @@
+package ecs
+
+import (
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// accessSystem is a System declaring its component access, which calls update
+// on Update.
+type accessSystem struct {
+	access   Access
+	priority int
+	after    []interface{}
+	update   func()
+}
+
+func (s *accessSystem) Access() Access        { return s.access }
+func (s *accessSystem) Priority() int         { return s.priority }
+func (s *accessSystem) Before() []interface{} { return nil }
+func (s *accessSystem) After() []interface{}  { return s.after }
+func (s *accessSystem) Remove(BasicEntity)    {}
+func (s *accessSystem) Update(dt float32) {
+	if s.update != nil {
+		s.update()
+	}
+}
+
+func TestAccessConflicts(t *testing.T) {
+	pos, vel := TypeOf[position](), TypeOf[velocity]()
+	readPos := Access{Reads: []reflect.Type{pos}}
+	writePos := Access{Writes: []reflect.Type{pos}}
+	writeVel := Access{Reads: []reflect.Type{pos}, Writes: []reflect.Type{vel}}
+
+	assert.False(t, readPos.conflicts(readPos), "two readers conflict")
+	assert.True(t, readPos.conflicts(writePos))
+	assert.True(t, writePos.conflicts(readPos))
+	assert.True(t, writePos.conflicts(writePos))
+	assert.True(t, writeVel.conflicts(writePos))
+	assert.False(t, writeVel.conflicts(readPos))
+}
+
+func TestSystemBatches(t *testing.T) {
+	pos, vel, hp := TypeOf[position](), TypeOf[velocity](), TypeOf[health]()
+	w := &World{}
+	a := &accessSystem{access: Access{Reads: []reflect.Type{pos}, Writes: []reflect.Type{vel}}}
+	b := &accessSystem{access: Access{Writes: []reflect.Type{hp}}}
+	c := &accessSystem{access: Access{Writes: []reflect.Type{pos}}}
+	d := &accessSystem{access: Access{Reads: []reflect.Type{pos}}, after: []interface{}{c}}
+	e := &accessSystem{access: Access{Reads: []reflect.Type{hp}}}
+	f := &accessSystem{access: Access{Reads: []reflect.Type{vel}}, priority: -1}
+	g := &funcSystem{func(float32) {}}
+	for _, sys := range []System{a, b, c, d, e, f, g} {
+		w.AddSystem(sys)
+	}
+
+	assert.Equal(t, [][]System{
+		{a, b}, // c writes what a reads
+		{c},    // d runs after c
+		{d, e},
+		{g}, // g does not declare its access
+		{f}, // f has a different priority
+	}, w.stage(StageUpdate).systemBatches())
+}
+
+// TestUpdateParallel makes sure systems without conflicts run at the same time,
+// and still see each other's results when they do conflict
+func TestUpdateParallel(t *testing.T) {
+	w := &World{}
+	w.SetWorkers(4)
+	assert.Equal(t, 4, w.Workers())
+
+	es := w.NewEntities(100)
+	for _, e := range es {
+		AddComponent(w, e.ID(), position{})
+		AddComponent(w, e.ID(), velocity{X: 1})
+		AddComponent(w, e.ID(), health{})
+	}
+
+	// Both systems wait for each other, which only finishes if they run in
+	// parallel.
+	var arrived int32
+	rendezvous := func() {
+		atomic.AddInt32(&arrived, 1)
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&arrived) < 2 && time.Now().Before(deadline) {
+			runtime.Gosched()
+		}
+	}
+
+	move := NewQuery2[position, velocity](w)
+	heal := NewQuery1[health](w)
+	check := NewQuery1[position](w)
+	var moved int
+	w.AddSystem(&accessSystem{
+		access: Access{Reads: []reflect.Type{TypeOf[velocity]()}, Writes: []reflect.Type{TypeOf[position]()}},
+		update: func() {
+			rendezvous()
+			move.Each(func(id uint64, p *position, v *velocity) {
+				p.X += v.X
+			})
+		},
+	})
+	w.AddSystem(&accessSystem{
+		access: Access{Writes: []reflect.Type{TypeOf[health]()}},
+		update: func() {
+			rendezvous()
+			heal.Each(func(id uint64, h *health) {
+				h.HP++
+				w.Commands().Run(func(*World) {})
+			})
+		},
+	})
+	w.AddSystem(&accessSystem{
+		access:   Access{Reads: []reflect.Type{TypeOf[position]()}},
+		priority: -1,
+		update: func() {
+			check.Each(func(id uint64, p *position) {
+				if p.X == 1 {
+					moved++
+				}
+			})
+		},
+	})
+
+	w.Update(1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&arrived), "systems without conflicts did not run in parallel")
+	assert.Equal(t, len(es), moved, "a later batch did not see the changes of an earlier one")
+	assert.Equal(t, 0, w.Commands().Len(), "commands of parallel systems were not applied")
+	for _, e := range es {
+		h, _ := GetComponent[health](w, e.ID())
+		assert.Equal(t, 1, h.HP)
+	}
+}
+
+// TestUpdateParallelCommands makes sure the commands of systems updated in
+// parallel are applied in the order of the systems
+func TestUpdateParallelCommands(t *testing.T) {
+	w := &World{}
+	w.SetWorkers(4)
+	var applied []int
+	systems := make([]*accessSystem, 4)
+	for i := range systems {
+		i := i
+		systems[i] = &accessSystem{
+			access: Access{Reads: []reflect.Type{TypeOf[position]()}},
+			update: func() {
+				// The later systems record their commands first.
+				time.Sleep(time.Duration(len(systems)-i) * time.Millisecond)
+				w.CommandsOf(systems[i]).Run(func(*World) {
+					applied = append(applied, i)
+				})
+			},
+		}
+		w.AddSystem(systems[i])
+	}
+	assert.Len(t, w.stage(StageUpdate).systemBatches(), 1)
+	assert.Same(t, w.Commands(), w.CommandsOf(systems[0]))
+
+	w.Update(1)
+	assert.Equal(t, []int{0, 1, 2, 3}, applied)
+	assert.Equal(t, 0, w.Commands().Len())
+}
+
+// TestUpdateParallelPanic makes sure a panic in a System updated in parallel is
+// raised on the goroutine calling Update
+func TestUpdateParallelPanic(t *testing.T) {
+	w := &World{}
+	w.SetWorkers(2)
+	var other *accessSystem
+	other = &accessSystem{
+		access: Access{Reads: []reflect.Type{TypeOf[position]()}},
+		update: func() {
+			w.CommandsOf(other).Run(func(*World) {})
+		},
+	}
+	w.AddSystem(&accessSystem{
+		access: Access{Reads: []reflect.Type{TypeOf[position]()}},
+		update: func() {
+			panic("system")
+		},
+	})
+	w.AddSystem(other)
+
+	assert.PanicsWithValue(t, "system", func() { w.Update(1) })
+	assert.Equal(t, 1, w.Commands().Len(), "the commands of the batch were not kept")
+	assert.Same(t, w.Commands(), w.CommandsOf(other))
+}
+
+// TestUpdateParallelDuplicate makes sure a System added several times is not
+// updated concurrently with itself
+func TestUpdateParallelDuplicate(t *testing.T) {
+	w := &World{}
+	w.SetWorkers(2)
+	updates := 0
+	var sys *accessSystem
+	sys = &accessSystem{
+		access: Access{Reads: []reflect.Type{TypeOf[position]()}},
+		update: func() {
+			updates++
+			w.CommandsOf(sys).Run(func(*World) {})
+		},
+	}
+	w.AddSystem(sys)
+	w.AddSystem(sys)
+	assert.Equal(t, [][]System{{sys}, {sys}}, w.stage(StageUpdate).systemBatches())
+
+	w.Update(1)
+	assert.Equal(t, 2, updates)
+	assert.Equal(t, 0, w.Commands().Len())
+}
+
+// valueAccessSystem is a System of an uncomparable type declaring its component
+// access.
+type valueAccessSystem struct {
+	reads   []reflect.Type
+	updates *int32
+}
+
+func (s valueAccessSystem) Access() Access     { return Access{Reads: s.reads} }
+func (s valueAccessSystem) Remove(BasicEntity) {}
+func (s valueAccessSystem) Update(float32)     { atomic.AddInt32(s.updates, 1) }
+
+// TestUpdateParallelUncomparable makes sure systems of uncomparable types are
+// updated on their own instead of panicking
+func TestUpdateParallelUncomparable(t *testing.T) {
+	w := &World{}
+	w.SetWorkers(2)
+	var updates int32
+	reads := []reflect.Type{TypeOf[position]()}
+	w.AddSystem(valueAccessSystem{reads: reads, updates: &updates})
+	w.AddSystem(valueAccessSystem{reads: reads, updates: &updates})
+	assert.Len(t, w.stage(StageUpdate).systemBatches(), 2)
+
+	assert.NotPanics(t, func() { w.Update(1) })
+	assert.Equal(t, int32(2), updates)
+}
+
+type (
+	registeredA struct{}
+	registeredB struct{}
+	registeredC struct{}
+	registeredD struct{}
+)
+
+// registeringSystem is a System declaring read access to T, which is
+// registered on the World during its first Update.
+func registeringSystem[T any](w *World) System {
+	return &accessSystem{
+		access: Access{Reads: []reflect.Type{TypeOf[T]()}},
+		update: func() {
+			HasComponent[T](w, 1)
+			NewQuery2[T, position](w).Each(func(uint64, *T, *position) {})
+		},
+	}
+}
+
+// TestUpdateParallelRegistering makes sure systems updated in parallel may use
+// component types and queries the World does not know yet
+func TestUpdateParallelRegistering(t *testing.T) {
+	w := &World{}
+	w.SetWorkers(4)
+	AddComponent(w, w.NewEntity().ID(), position{})
+	w.AddSystem(registeringSystem[registeredA](w))
+	w.AddSystem(registeringSystem[registeredB](w))
+	w.AddSystem(registeringSystem[registeredC](w))
+	w.AddSystem(registeringSystem[registeredD](w))
+	assert.Len(t, w.stage(StageUpdate).systemBatches(), 1)
+
+	w.Update(1)
+	assert.Len(t, w.components, 5)
+	assert.Len(t, w.queries, 4)
+}
+
+// benchParallel updates systems which each do some work on a component type of
+// their own.
+func benchParallel(b *testing.B, workers int) {
+	const systemCount, entityCount = 8, 10000
+	w := &World{}
+	w.SetWorkers(workers)
+	es := w.NewEntities(entityCount)
+	for _, e := range es {
+		AddComponent(w, e.ID(), position{})
+	}
+	for i := 0; i < systemCount; i++ {
+		w.AddSystem(&accessSystem{
+			access: Access{Reads: []reflect.Type{TypeOf[position]()}},
+			update: func() {
+				var sum float32
+				for j := 0; j < 10; j++ {
+					for _, p := range StorageOf[position](w).Components() {
+						sum += p.X * p.Y
+					}
+				}
+				_ = sum
+			},
+		})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Update(1 / 120)
+	}
+}
+
+func BenchmarkUpdateSerial(b *testing.B) {
+	benchParallel(b, 1)
+}
+
+func BenchmarkUpdateParallel(b *testing.B) {
+	benchParallel(b, runtime.GOMAXPROCS(0))
+}
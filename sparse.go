@@ -0,0 +1,122 @@
+package ecs
+
+// sparsePageSize is the number of entries in a page of a sparseSet.
+const sparsePageSize = 4096
+
+// sparseSet is a set of entity IDs. It keeps a sparse array indexed by the
+// index part of an ID, pointing into a densely packed array of the IDs
+// themselves. Lookups, insertions and removals take constant time, and the
+// dense array can be iterated without gaps. The sparse array is allocated in
+// pages, so only the ranges of indices in use take up memory.
+//
+// Since only one ID per index can be live at a time, inserting an ID replaces
+// any ID with the same index but an older generation, while an ID older than the
+// one in the set is refused.
+type sparseSet struct {
+	// pages holds the position in dense plus one for every index, so that the
+	// zero value means the index is not in the set.
+	pages [][]uint32
+	dense []uint64
+}
+
+// find returns the position of the ID in the dense array, and whether it is in
+// the set.
+func (s *sparseSet) find(id uint64) (int, bool) {
+	index := IDIndex(id)
+	page := int(index / sparsePageSize)
+	if page >= len(s.pages) || s.pages[page] == nil {
+		return 0, false
+	}
+	pos := int(s.pages[page][index%sparsePageSize]) - 1
+	if pos < 0 || s.dense[pos] != id {
+		return 0, false
+	}
+	return pos, true
+}
+
+// insert adds the ID to the set, and returns its position in the dense array.
+// reused is false if the position is a new one at the end of the dense array,
+// or true if an existing position was reused, either by the ID itself or by an
+// older generation of it. ok is false if the set holds a newer generation of
+// the ID, which is left in place.
+func (s *sparseSet) insert(id uint64) (pos int, reused, ok bool) {
+	index := IDIndex(id)
+	page := int(index / sparsePageSize)
+	if page >= len(s.pages) {
+		s.pages = append(s.pages, make([][]uint32, page+1-len(s.pages))...)
+	}
+	if s.pages[page] == nil {
+		s.pages[page] = make([]uint32, sparsePageSize)
+	}
+
+	slot := &s.pages[page][index%sparsePageSize]
+	if *slot != 0 {
+		pos := int(*slot) - 1
+		if IDGeneration(s.dense[pos]) > IDGeneration(id) {
+			return 0, false, false
+		}
+		s.dense[pos] = id
+		return pos, true, true
+	}
+
+	s.dense = append(s.dense, id)
+	*slot = uint32(len(s.dense))
+	return len(s.dense) - 1, false, true
+}
+
+// older returns the ID with the same index but an older generation which the set
+// holds, and whether it holds one.
+func (s *sparseSet) older(id uint64) (uint64, bool) {
+	index := IDIndex(id)
+	page := int(index / sparsePageSize)
+	if page >= len(s.pages) || s.pages[page] == nil {
+		return 0, false
+	}
+	pos := int(s.pages[page][index%sparsePageSize]) - 1
+	if pos < 0 || IDGeneration(s.dense[pos]) >= IDGeneration(id) {
+		return 0, false
+	}
+	return s.dense[pos], true
+}
+
+// stale reports whether the set holds a newer generation of the ID.
+func (s *sparseSet) stale(id uint64) bool {
+	index := IDIndex(id)
+	page := int(index / sparsePageSize)
+	if page >= len(s.pages) || s.pages[page] == nil {
+		return false
+	}
+	pos := int(s.pages[page][index%sparsePageSize]) - 1
+	return pos >= 0 && IDGeneration(s.dense[pos]) > IDGeneration(id)
+}
+
+// remove removes the ID from the set by moving the last ID of the dense array
+// into its position. It returns the position of the removed ID, and whether the
+// ID was in the set; callers keeping data parallel to the dense array should
+// move their last element into that position as well.
+func (s *sparseSet) remove(id uint64) (int, bool) {
+	pos, ok := s.find(id)
+	if !ok {
+		return 0, false
+	}
+
+	last := len(s.dense) - 1
+	if pos != last {
+		moved := s.dense[last]
+		s.dense[pos] = moved
+		s.setSlot(moved, pos+1)
+	}
+	s.dense = s.dense[:last]
+	s.setSlot(id, 0)
+	return pos, true
+}
+
+func (s *sparseSet) setSlot(id uint64, value int) {
+	index := IDIndex(id)
+	s.pages[index/sparsePageSize][index%sparsePageSize] = uint32(value)
+}
+
+// len returns the number of IDs in the set.
+func (s *sparseSet) len() int {
+	return len(s.dense)
+}
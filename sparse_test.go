@@ -0,0 +1,65 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSparseSetInsertRemove(t *testing.T) {
+	var s sparseSet
+	ids := []uint64{PackID(1, 0), PackID(2, 0), PackID(sparsePageSize*3+5, 0)}
+	for i, id := range ids {
+		pos, reused, ok := s.insert(id)
+		assert.True(t, ok)
+		assert.False(t, reused)
+		assert.Equal(t, i, pos)
+	}
+	assert.Equal(t, 3, s.len())
+	assert.Nil(t, s.pages[1], "a page without indices in use was allocated")
+
+	pos, reused, _ := s.insert(ids[1])
+	assert.True(t, reused, "inserting an ID twice created a new position")
+	assert.Equal(t, 1, pos)
+
+	pos, ok := s.remove(ids[0])
+	assert.True(t, ok)
+	assert.Equal(t, 0, pos)
+	assert.Equal(t, []uint64{ids[2], ids[1]}, s.dense, "the last ID was not swapped into the removed position")
+
+	pos, ok = s.find(ids[2])
+	assert.True(t, ok)
+	assert.Equal(t, 0, pos)
+
+	_, ok = s.find(ids[0])
+	assert.False(t, ok)
+	_, ok = s.remove(ids[0])
+	assert.False(t, ok)
+}
+
+// TestSparseSetGenerations makes sure only one generation of an index is in the set
+func TestSparseSetGenerations(t *testing.T) {
+	var s sparseSet
+	old, recycled := PackID(7, 0), PackID(7, 1)
+	s.insert(old)
+
+	_, ok := s.find(recycled)
+	assert.False(t, ok, "a newer generation was found in the set")
+
+	assert.False(t, s.stale(recycled))
+	pos, reused, ok := s.insert(recycled)
+	assert.True(t, ok)
+	assert.True(t, reused, "the newer generation did not replace the older one")
+	assert.Equal(t, 0, pos)
+	assert.Equal(t, 1, s.len())
+
+	assert.True(t, s.stale(old))
+	_, _, ok = s.insert(old)
+	assert.False(t, ok, "the older generation replaced the newer one")
+	assert.Equal(t, []uint64{recycled}, s.dense)
+
+	_, ok = s.find(old)
+	assert.False(t, ok, "the older generation is still in the set")
+	_, ok = s.remove(old)
+	assert.False(t, ok, "the older generation removed the newer one")
+}
@@ -0,0 +1,278 @@
+package ecs
+
+import (
+	"fmt"
+	"math"
+)
+
+// The names of the stages of every World, in the order they are updated.
+const (
+	// StagePreUpdate is meant for systems preparing the frame, like input.
+	StagePreUpdate = "PreUpdate"
+	// StageFixedUpdate is updated at a fixed timestep, which suits physics.
+	StageFixedUpdate = "FixedUpdate"
+	// StageUpdate is the stage systems are added to by default.
+	StageUpdate = "Update"
+	// StagePostUpdate is meant for systems reacting to the simulation.
+	StagePostUpdate = "PostUpdate"
+	// StageRender is meant for systems drawing the frame.
+	StageRender = "Render"
+)
+
+// The timestep of StageFixedUpdate, unless changed with SetFixedTimestep.
+const (
+	DefaultFixedStep     float32 = 1.0 / 60
+	DefaultMaxFixedSteps         = 5
+)
+
+// A stage is a named group of systems, updated together.
+type stage struct {
+	name    string
+	systems systems
+	// filters holds the filter every System was added with by
+	// AddSystemInterface, by its position in systems, or nil.
+	filters []*systemFilter
+	// batches caches the groups of systems which can be updated in parallel.
+	batches [][]System
+
+	// step is the fixed timestep of the stage, or 0 when its systems are
+	// updated once per frame. The accumulator holds the frame time not
+	// simulated yet, and maxSteps caps the steps per frame, if not 0.
+	step        float32
+	maxSteps    int
+	accumulator float32
+}
+
+// setSystems replaces the systems of the stage and their filters, resetting
+// what was cached.
+func (s *stage) setSystems(list systems, filters []*systemFilter) {
+	s.systems, s.filters = list, filters
+	s.batches = nil
+}
+
+// orderWith returns the systems of the stage with the System added with the
+// given filter, and their filters, sorted by their ordering constraints and
+// priority.
+func (s *stage) orderWith(system System, filter *systemFilter) (systems, []*systemFilter, error) {
+	list := make(systems, 0, len(s.systems)+1)
+	filters := make([]*systemFilter, 0, len(s.systems)+1)
+	return ordered(append(append(list, s.systems...), system), append(append(filters, s.filters...), filter))
+}
+
+// ordered sorts the systems by their ordering constraints and priority, along
+// with their filters.
+func ordered(list systems, filters []*systemFilter) (systems, []*systemFilter, error) {
+	order, err := orderSystems(list)
+	if err != nil {
+		return nil, nil, err
+	}
+	sorted := make(systems, len(order))
+	sortedFilters := make([]*systemFilter, len(order))
+	for i, j := range order {
+		sorted[i], sortedFilters[i] = list[j], filters[j]
+	}
+	return sorted, sortedFilters, nil
+}
+
+// systemConfig holds the settings applied by SystemOptions.
+type systemConfig struct {
+	stage string
+}
+
+// A SystemOption changes how a System is added to a World.
+type SystemOption func(*systemConfig)
+
+// InStage adds the System to the stage with the given name, instead of
+// StageUpdate.
+func InStage(name string) SystemOption {
+	return func(c *systemConfig) {
+		c.stage = name
+	}
+}
+
+// stageConfig holds the settings applied by StageOptions.
+type stageConfig struct {
+	before, after string
+	step          float32
+	maxSteps      int
+}
+
+// A StageOption changes where a stage is added to a World.
+type StageOption func(*stageConfig)
+
+// StageBefore adds the stage right before the stage with the given name.
+func StageBefore(name string) StageOption {
+	return func(c *stageConfig) {
+		c.before = name
+	}
+}
+
+// StageAfter adds the stage right after the stage with the given name.
+func StageAfter(name string) StageOption {
+	return func(c *stageConfig) {
+		c.after = name
+	}
+}
+
+// FixedTimestep updates the systems of the stage at a fixed timestep, see
+// SetFixedTimestep.
+func FixedTimestep(step float32, maxSteps int) StageOption {
+	return func(c *stageConfig) {
+		c.step, c.maxSteps = step, maxSteps
+	}
+}
+
+// stageList returns the stages of the World, in the order they are updated,
+// creating the default ones when needed.
+func (w *World) stageList() []*stage {
+	if w.stages == nil {
+		for _, name := range []string{StagePreUpdate, StageFixedUpdate, StageUpdate, StagePostUpdate, StageRender} {
+			w.stages = append(w.stages, &stage{name: name})
+		}
+		fixed := w.stages[1]
+		fixed.step, fixed.maxSteps = DefaultFixedStep, DefaultMaxFixedSteps
+	}
+	return w.stages
+}
+
+// stage returns the stage with the given name, or nil if there is none.
+func (w *World) stage(name string) *stage {
+	for _, s := range w.stageList() {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// stageIndex returns the position of the stage with the given name. It panics if
+// there is none.
+func (w *World) stageIndex(name string) int {
+	for i, s := range w.stageList() {
+		if s.name == name {
+			return i
+		}
+	}
+	panic(fmt.Sprintf("ecs: there is no stage named %q", name))
+}
+
+// AddStage adds a new, empty stage with the given name. It is updated after
+// every other stage, unless StageBefore or StageAfter is given. It panics if
+// the World already has a stage with the name, or the stage to add it next to
+// does not exist.
+func (w *World) AddStage(name string, opts ...StageOption) {
+	if w.stage(name) != nil {
+		panic(fmt.Sprintf("ecs: there already is a stage named %q", name))
+	}
+
+	var c stageConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	at := len(w.stageList())
+	if c.before != "" {
+		at = w.stageIndex(c.before)
+	} else if c.after != "" {
+		at = w.stageIndex(c.after) + 1
+	}
+
+	w.stages = append(w.stages, nil)
+	copy(w.stages[at+1:], w.stages[at:])
+	w.stages[at] = &stage{name: name, step: c.step, maxSteps: c.maxSteps}
+}
+
+// SetFixedTimestep makes the stage with the given name update its systems at a
+// fixed timestep. Every Update adds its dt to an accumulator, and the systems
+// are updated with a dt of step for as long as a whole step has accumulated. At
+// most maxSteps steps are run per Update, if it is not 0, dropping the frame
+// time left to catch up with. A step of 0 makes the stage update its systems
+// once per Update again. It panics if there is no such stage.
+func (w *World) SetFixedTimestep(name string, step float32, maxSteps int) {
+	s := w.stageList()[w.stageIndex(name)]
+	s.step, s.maxSteps, s.accumulator = step, maxSteps, 0
+}
+
+// Alpha returns how far the time accumulated by the fixed timestep stage with
+// the given name is into its next step, between 0 and 1. Render systems use it
+// to interpolate between the last two fixed steps. It returns 1 for stages
+// without a fixed timestep, and panics if there is no such stage.
+func (w *World) Alpha(name string) float32 {
+	s := w.stageList()[w.stageIndex(name)]
+	if s.step <= 0 {
+		return 1
+	}
+	return s.accumulator / s.step
+}
+
+// Stages returns the names of the stages of the World, in the order they are
+// updated.
+func (w *World) Stages() []string {
+	names := make([]string, 0, len(w.stageList()))
+	for _, s := range w.stageList() {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// StageSystems returns the systems in the stage with the given name, in the
+// order they are updated. It panics if there is no such stage.
+func (w *World) StageSystems(name string) []System {
+	return w.stageList()[w.stageIndex(name)].systems
+}
+
+// rebuildSystems updates the list of all systems after the systems of a stage
+// changed. It builds a new list, as callers may still hold the old one.
+func (w *World) rebuildSystems() {
+	n := 0
+	for _, s := range w.stageList() {
+		n += len(s.systems)
+	}
+	list := make(systems, 0, n)
+	filters := make([]*systemFilter, 0, n)
+	for _, s := range w.stageList() {
+		list = append(list, s.systems...)
+		filters = append(filters, s.filters...)
+	}
+	w.systems, w.systemFilters = list, filters
+}
+
+// updateStage updates the stage, as many times as there are fixed steps to run
+// if it has a fixed timestep.
+func (w *World) updateStage(s *stage, dt float32) {
+	if s.step <= 0 {
+		w.runStage(s, dt)
+		return
+	}
+
+	s.accumulator += dt
+	for steps := 0; s.accumulator >= s.step; steps++ {
+		if s.maxSteps > 0 && steps == s.maxSteps {
+			s.accumulator = float32(math.Mod(float64(s.accumulator), float64(s.step)))
+			break
+		}
+		w.runStage(s, s.step)
+		s.accumulator -= s.step
+	}
+}
+
+// runStage updates every enabled System in the stage once, applying the recorded
+// Commands after each of them.
+func (w *World) runStage(s *stage, dt float32) {
+	if w.Workers() > 1 {
+		w.updateParallel(s, dt)
+		return
+	}
+	for _, system := range s.systems {
+		if len(w.disabled) > 0 && !w.SystemEnabled(system) {
+			continue
+		}
+		// No other goroutine uses the tick between systems updated one by one,
+		// so it is incremented without the cost of nextTick.
+		w.tick++
+		system.Update(dt)
+		if w.commands.Len() > 0 {
+			w.FlushCommands()
+		}
+	}
+}
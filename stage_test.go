@@ -0,0 +1,91 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorld_DefaultStages(t *testing.T) {
+	w := &World{}
+	assert.Equal(t, []string{StagePreUpdate, StageFixedUpdate, StageUpdate, StagePostUpdate, StageRender}, w.Stages())
+}
+
+func TestWorld_AddStage(t *testing.T) {
+	w := &World{}
+	w.AddStage("Last")
+	w.AddStage("First", StageBefore(StagePreUpdate))
+	w.AddStage("Physics", StageAfter(StageUpdate))
+	assert.Equal(t, []string{"First", StagePreUpdate, StageFixedUpdate, StageUpdate, "Physics", StagePostUpdate, StageRender, "Last"}, w.Stages())
+
+	assert.Panics(t, func() { w.AddStage(StageUpdate) }, "stage names are unique")
+	assert.Panics(t, func() { w.AddStage("Other", StageAfter("Missing")) })
+	assert.Panics(t, func() { w.AddSystem(&funcSystem{}, InStage("Missing")) })
+}
+
+// TestWorld_UpdateStages makes sure stages are updated in order, whatever the
+// priority of their systems.
+func TestWorld_UpdateStages(t *testing.T) {
+	w := &World{}
+	w.AddStage("Physics", StageAfter(StageUpdate))
+
+	var order []string
+	record := func(name string) *funcSystem {
+		return &funcSystem{func(float32) { order = append(order, name) }}
+	}
+	render := record("render")
+	update := record("update")
+	w.AddSystem(render, InStage(StageRender))
+	w.AddSystem(&priorityChangeSystem{Rank: 500}, InStage(StageRender))
+	w.AddSystem(update)
+	w.AddSystem(record("physics"), InStage("Physics"))
+	w.AddSystem(record("input"), InStage(StagePreUpdate))
+
+	w.Update(0)
+	assert.Equal(t, []string{"input", "update", "physics", "render"}, order)
+	assert.Equal(t, []System{update}, w.StageSystems(StageUpdate))
+	assert.Len(t, w.Systems(), 5)
+	assert.Equal(t, render, w.Systems()[4])
+
+	order = nil
+	w.SetWorkers(2)
+	w.Update(0)
+	assert.Equal(t, []string{"input", "update", "physics", "render"}, order)
+}
+
+func TestWorld_FixedTimestep(t *testing.T) {
+	w := &World{}
+	w.SetFixedTimestep(StageFixedUpdate, 0.25, 3)
+
+	var steps []float32
+	w.AddSystem(&funcSystem{func(dt float32) { steps = append(steps, dt) }}, InStage(StageFixedUpdate))
+
+	w.Update(0.125)
+	assert.Empty(t, steps, "less than a step accumulated")
+	assert.Equal(t, float32(0.5), w.Alpha(StageFixedUpdate))
+
+	w.Update(0.5)
+	assert.Equal(t, []float32{0.25, 0.25}, steps)
+	assert.Equal(t, float32(0.5), w.Alpha(StageFixedUpdate))
+
+	steps = nil
+	w.Update(2)
+	assert.Equal(t, []float32{0.25, 0.25, 0.25}, steps, "catching up is capped")
+	assert.Equal(t, float32(0.5), w.Alpha(StageFixedUpdate), "the remainder is kept")
+
+	assert.Equal(t, float32(1), w.Alpha(StageUpdate))
+}
+
+func TestWorld_AddFixedStage(t *testing.T) {
+	w := &World{}
+	w.AddStage("Physics", FixedTimestep(0.5, 0))
+
+	n := 0
+	w.AddSystem(&funcSystem{func(dt float32) { n++ }}, InStage("Physics"))
+	w.Update(10)
+	assert.Equal(t, 20, n, "steps are not capped")
+
+	w.SetFixedTimestep("Physics", 0, 0)
+	w.Update(10)
+	assert.Equal(t, 21, n)
+}
@@ -0,0 +1,140 @@
+package ecs
+
+// componentStorage is implemented by every Storage, so the World can use them
+// without knowing the component types.
+type componentStorage interface {
+	Has(id uint64) bool
+	Remove(id uint64) bool
+	Len() int
+	IDs() []uint64
+}
+
+// Storage stores components of type T by entity ID. It is a sparse set: the
+// components are packed densely in a slice, so iterating over them is a tight
+// loop over contiguous memory, while an array indexed by entity ID keeps adding,
+// getting and removing the component of an entity at constant time. Removing a
+// component moves the last one into its place.
+//
+// Pointers returned by a Storage are only valid until the next call to Add or
+// Remove, since both may move components around.
+type Storage[T any] struct {
+	set  sparseSet
+	data []T
+
+	// owner is notified of added and removed components when the Storage is
+	// registered on a World.
+	owner *componentType
+}
+
+// NewStorage creates a new, empty Storage.
+func NewStorage[T any]() *Storage[T] {
+	return &Storage[T]{}
+}
+
+// StorageOf returns the Storage for components of type T registered on the
+// World, creating it when there is none yet. Components in it are removed
+// automatically when their entity is removed via World.RemoveEntity. It panics
+// if the World is in ArchetypeStorage mode.
+func StorageOf[T any](w *World) *Storage[T] {
+	if w.storageMode != SparseStorage {
+		panic("ecs: StorageOf is only available in SparseStorage mode")
+	}
+	return componentTypeOf[T](w).storage.(*Storage[T])
+}
+
+// Add sets the component of the entity with the given ID, replacing the one it
+// already has, and returns a pointer to the stored component. A component of an
+// older generation of the entity is replaced as well, while a stale ID of which
+// a newer generation has a component is refused, returning nil. In a Storage of
+// a World, every component of the older generation is removed first instead,
+// since it is no longer alive.
+func (s *Storage[T]) Add(id uint64, c T) *T {
+	var had bool
+	if s.owner != nil {
+		s.owner.w.checkStructural()
+		if old, ok := s.set.older(id); ok {
+			s.owner.w.removeComponents(old)
+		}
+		_, had = s.set.find(id)
+	}
+
+	i, reused, ok := s.set.insert(id)
+	if !ok {
+		return nil
+	}
+	if reused {
+		s.data[i] = c
+	} else {
+		s.data = append(s.data, c)
+	}
+
+	if s.owner != nil {
+		s.owner.added(id, had)
+	}
+	return &s.data[i]
+}
+
+// Get returns the component of the entity with the given ID, and whether it has
+// one.
+func (s *Storage[T]) Get(id uint64) (*T, bool) {
+	i, ok := s.set.find(id)
+	if !ok {
+		return nil, false
+	}
+	return &s.data[i], true
+}
+
+// Has reports whether the entity with the given ID has a component stored.
+func (s *Storage[T]) Has(id uint64) bool {
+	_, ok := s.set.find(id)
+	return ok
+}
+
+// Remove removes the component of the entity with the given ID, and reports
+// whether there was one. The last component is moved into the freed slot.
+func (s *Storage[T]) Remove(id uint64) bool {
+	if s.owner != nil {
+		s.owner.w.checkStructural()
+	}
+	i, ok := s.set.remove(id)
+	if !ok {
+		return false
+	}
+
+	last := len(s.data) - 1
+	s.data[i] = s.data[last]
+
+	var zero T
+	s.data[last] = zero
+	s.data = s.data[:last]
+
+	if s.owner != nil {
+		s.owner.removed(id)
+	}
+	return true
+}
+
+// Len returns the number of components stored.
+func (s *Storage[T]) Len() int {
+	return len(s.data)
+}
+
+// IDs returns the IDs of the entities with a component stored, in the same order
+// as Components. The slice must not be modified.
+func (s *Storage[T]) IDs() []uint64 {
+	return s.set.dense
+}
+
+// Components returns the stored components, densely packed. The components may
+// be modified, but the slice is only valid until the next call to Add or Remove.
+func (s *Storage[T]) Components() []T {
+	return s.data
+}
+
+// Each calls fn for every stored component, with the ID of its entity. fn must
+// not add or remove components of the Storage.
+func (s *Storage[T]) Each(fn func(id uint64, c *T)) {
+	for i := range s.data {
+		fn(s.set.dense[i], &s.data[i])
+	}
+}
@@ -0,0 +1,214 @@
+package ecs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type position struct {
+	X, Y float32
+}
+
+type velocity struct {
+	X, Y float32
+}
+
+func TestStorageAddGetRemove(t *testing.T) {
+	s := NewStorage[position]()
+	es := NewBasics(3)
+	for i, e := range es {
+		s.Add(e.ID(), position{X: float32(i)})
+	}
+	assert.Equal(t, 3, s.Len())
+
+	p, ok := s.Get(es[1].ID())
+	assert.True(t, ok)
+	assert.Equal(t, float32(1), p.X)
+
+	p.Y = 5
+	p, _ = s.Get(es[1].ID())
+	assert.Equal(t, float32(5), p.Y, "changes through the returned pointer were lost")
+
+	s.Add(es[1].ID(), position{X: 10})
+	assert.Equal(t, 3, s.Len(), "adding an existing component should replace it")
+	p, _ = s.Get(es[1].ID())
+	assert.Equal(t, float32(10), p.X)
+
+	assert.True(t, s.Remove(es[0].ID()))
+	assert.False(t, s.Remove(es[0].ID()), "removed the same component twice")
+	assert.False(t, s.Has(es[0].ID()))
+	assert.Equal(t, 2, s.Len())
+
+	// The last component was moved into the freed slot.
+	p, ok = s.Get(es[2].ID())
+	assert.True(t, ok)
+	assert.Equal(t, float32(2), p.X)
+	assert.Equal(t, []uint64{es[2].ID(), es[1].ID()}, s.IDs())
+}
+
+func TestStorageZeroValue(t *testing.T) {
+	var s Storage[position]
+	e := NewBasic()
+	_, ok := s.Get(e.ID())
+	assert.False(t, ok)
+	s.Add(e.ID(), position{X: 1})
+	assert.True(t, s.Has(e.ID()))
+}
+
+func TestStorageEach(t *testing.T) {
+	s := NewStorage[position]()
+	for _, e := range NewBasics(10) {
+		s.Add(e.ID(), position{X: 1})
+	}
+	s.Each(func(id uint64, p *position) {
+		p.X++
+	})
+	for _, p := range s.Components() {
+		assert.Equal(t, float32(2), p.X)
+	}
+}
+
+// TestStorageOf makes sure storages are registered on the world and cleaned up
+// when entities are removed
+func TestStorageOf(t *testing.T) {
+	w := &World{}
+	assert.Same(t, StorageOf[position](w), StorageOf[position](w), "StorageOf created a second storage for the same type")
+
+	e := w.NewEntity()
+	StorageOf[position](w).Add(e.ID(), position{})
+	StorageOf[velocity](w).Add(e.ID(), velocity{})
+
+	w.RemoveEntity(e)
+	assert.False(t, StorageOf[position](w).Has(e.ID()), "RemoveEntity did not remove the position")
+	assert.False(t, StorageOf[velocity](w).Has(e.ID()), "RemoveEntity did not remove the velocity")
+}
+
+// TestStorageGenerations makes sure a component of a removed entity does not
+// leak into the entity recycling its index
+func TestStorageGenerations(t *testing.T) {
+	s := NewStorage[position]()
+	a := IDAllocator{}
+	old := a.NewID()
+	s.Add(old, position{X: 1})
+	a.Free(old)
+	recycled := a.NewID()
+
+	assert.False(t, s.Has(recycled))
+	s.Add(recycled, position{X: 2})
+	assert.Equal(t, 1, s.Len())
+	assert.False(t, s.Has(old))
+	p, _ := s.Get(recycled)
+	assert.Equal(t, float32(2), p.X)
+}
+
+const benchStorageEntities = 100000
+
+type benchPointerEntity struct {
+	e *BasicEntity
+	p *position
+	v *velocity
+}
+
+// BenchmarkPointerSliceUpdate iterates over a slice of pointers, the way systems
+// storing their own entities do.
+func BenchmarkPointerSliceUpdate(b *testing.B) {
+	entities := make([]benchPointerEntity, benchStorageEntities)
+	for i := range entities {
+		e := NewBasic()
+		entities[i] = benchPointerEntity{&e, &position{}, &velocity{X: 1, Y: 1}}
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, e := range entities {
+			e.p.X += e.v.X
+			e.p.Y += e.v.Y
+		}
+	}
+}
+
+// BenchmarkStorageUpdate iterates over the densely packed components of a
+// Storage.
+func BenchmarkStorageUpdate(b *testing.B) {
+	s := NewStorage[position]()
+	for _, e := range NewBasics(benchStorageEntities) {
+		s.Add(e.ID(), position{})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ps := s.Components()
+		for j := range ps {
+			ps[j].X++
+			ps[j].Y++
+		}
+	}
+}
+
+// BenchmarkStorageUpdateJoin iterates over one Storage, looking up the matching
+// component in another.
+func BenchmarkStorageUpdateJoin(b *testing.B) {
+	ps, vs := NewStorage[position](), NewStorage[velocity]()
+	for _, e := range NewBasics(benchStorageEntities) {
+		ps.Add(e.ID(), position{})
+		vs.Add(e.ID(), velocity{X: 1, Y: 1})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ids, data := ps.IDs(), ps.Components()
+		for j := range data {
+			v, ok := vs.Get(ids[j])
+			if !ok {
+				continue
+			}
+			data[j].X += v.X
+			data[j].Y += v.Y
+		}
+	}
+}
+
+// BenchmarkPointerSliceRemove removes and re-adds an entity from the middle of a
+// slice, the way systems storing their own entities do.
+func BenchmarkPointerSliceRemove(b *testing.B) {
+	entities := make([]benchPointerEntity, benchStorageEntities)
+	for i := range entities {
+		e := NewBasic()
+		entities[i] = benchPointerEntity{&e, &position{}, &velocity{}}
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		target := entities[benchStorageEntities/2]
+		for index, e := range entities {
+			if e.e.ID() == target.e.ID() {
+				entities = append(entities[:index], entities[index+1:]...)
+				break
+			}
+		}
+		entities = append(entities, target)
+	}
+}
+
+// BenchmarkStorageRemove removes and re-adds an entity from the middle of a
+// Storage, which swaps the last component into its place.
+func BenchmarkStorageRemove(b *testing.B) {
+	s := NewStorage[position]()
+	es := NewBasics(benchStorageEntities)
+	for _, e := range es {
+		s.Add(e.ID(), position{})
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		id := es[i%len(es)].ID()
+		s.Remove(id)
+		s.Add(id, position{})
+	}
+}
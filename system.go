@@ -34,6 +34,35 @@ type Prioritizer interface {
 	Priority() int
 }
 
+// Labeler gives a System a label, which the ordering constraints of other
+// systems may refer to. Any number of systems may share a label.
+type Labeler interface {
+	// Label returns the label of the System.
+	Label() string
+}
+
+// Dependencies declares ordering constraints between a System and other
+// systems. Both methods return Systems, or labels of systems as strings.
+// Constraints only apply within a stage: those referring to systems in other
+// stages, or not in the World, are ignored. Order the stages themselves instead.
+// Priority only decides the order of systems not constrained by Dependencies.
+type Dependencies interface {
+	// Before returns the systems this System must be updated before.
+	Before() []interface{}
+
+	// After returns the systems this System must be updated after.
+	After() []interface{}
+}
+
+// Accessor declares the component types a System reads and writes during
+// Update. When the World updates systems in parallel, systems whose access
+// does not conflict may be updated at the same time. Systems not implementing
+// Accessor are always updated on their own.
+type Accessor interface {
+	// Access returns the component types the System reads and writes.
+	Access() Access
+}
+
 // Initializer provides initialization of systems.
 type Initializer interface {
 	// New initializes the given System, and may be used to initialize some
@@ -41,6 +70,14 @@ type Initializer interface {
 	New(*World)
 }
 
+// Finalizer provides teardown of systems, the counterpart of Initializer.
+type Finalizer interface {
+	// Finalize is called when the System is removed from the given World, and
+	// should release what the System holds on to, like goroutines, files and
+	// channels.
+	Finalize(*World) error
+}
+
 // systems implements a sortable list of `System`. It is indexed on
 // `System.Priority()`.
 type systems []System
@@ -1,121 +1,622 @@
 package ecs
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
-	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// ErrClosed is the error Update, AddSystem and AddEntity panic with once the
+// World is closed, and which Close returns when called again.
+var ErrClosed = errors.New("ecs: world is closed")
+
+// The errors returned by TryAddSystem and TryAddSystemInterface.
+var (
+	ErrNotPointer       = errors.New("ecs: filter is not a pointer")
+	ErrNotInterface     = errors.New("ecs: filter does not point to an interface")
+	ErrSystemRegistered = errors.New("ecs: system is already registered")
+	ErrUnknownStage     = errors.New("ecs: there is no such stage")
+)
+
+// FilterError is returned by TryAddSystemInterface when a filter is invalid.
+type FilterError struct {
+	// Filter is the invalid filter.
+	Filter interface{}
+	// Err is ErrNotPointer or ErrNotInterface.
+	Err error
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%v: %T", e.Err, e.Filter)
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// CloseError is returned by Close when systems failed to finalize.
+type CloseError struct {
+	// Errors are the errors returned by the systems, in the order they were
+	// finalized.
+	Errors []error
+}
+
+func (e *CloseError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return "ecs: finalizing systems failed: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors returned by the systems.
+func (e *CloseError) Unwrap() []error {
+	return e.Errors
+}
+
+// Is reports whether any of the errors returned by the systems matches target,
+// so that errors.Is looks into them before Go 1.20 as well.
+func (e *CloseError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors returned by the systems matching target, so
+// that errors.As looks into them before Go 1.20 as well.
+func (e *CloseError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // World contains a bunch of Entities, and a bunch of Systems. It is the
 // recommended way to run ecs.
 type World struct {
-	systems      systems
-	sysIn, sysEx map[reflect.Type][]reflect.Type
+	systems     systems
+	filters     []*systemFilter
+	allocator   Allocator
+	components  map[reflect.Type]*componentType
+	storageMode StorageMode
+	archetypes  archetypeStore
+	queries     map[queryKey]*queryState
+
+	// systemFilters holds the filter of every System by its position in
+	// systems, or nil if it has none.
+	systemFilters []*systemFilter
+
+	// entities are the entities added by AddEntity, indexed by ID.
+	entities EntitySet[Identifier]
+
+	// registry guards components and queries, which systems updated in
+	// parallel may register at the same time.
+	registry sync.RWMutex
+
+	// tick is incremented before every System, or batch of systems updated
+	// in parallel, and frameTick is the first tick of the current Update.
+	tick, frameTick uint64
+
+	commands Commands
+	// batchSystems is the batch of systems being updated in parallel, and
+	// batchCommands their own Commands by position in it, see CommandsOf.
+	batchSystems  []System
+	batchCommands []Commands
+
+	// stages group the systems; systems holds those of every stage, in the
+	// order they are updated.
+	stages []*stage
+	// disabled are the systems skipped by Update.
+	disabled map[System]struct{}
+
+	// workers is the number of systems updated in parallel, and parWorkers
+	// the number of goroutines of ParEach.
+	workers, parWorkers int
+
+	// closed is set by Close.
+	closed bool
+
+	// iterating counts the queries being iterated over in parallel, during
+	// which structural changes are not allowed.
+	iterating int32
 }
 
-// AddSystem adds the given System to the World, sorted by priority.
-func (w *World) AddSystem(system System) {
-	if initializer, ok := system.(Initializer); ok {
-		initializer.New(w)
+// SetAllocator sets the Allocator the World creates and frees entity IDs with.
+// By default a World shares the allocator of NewBasic and NewBasics with every
+// other World, so the IDs it hands out depend on the entities created by other
+// worlds as well. Giving each World its own Allocator is required to keep their
+// IDs independent and deterministic. It should be called before any entities
+// are created.
+//
+// The IDs of NewBasic and NewBasics then overlap with those of the World, so
+// they should not be mixed in the same World: systems and components only tell
+// entities apart by ID. Removing a BasicEntity created by NewBasic frees its ID
+// with the allocator of NewBasic rather than the one of the World, but an
+// Identifier which is not a BasicEntity nor embeds one is always freed with the
+// Allocator of the World.
+func (w *World) SetAllocator(a Allocator) {
+	w.allocator = a
+}
+
+// Allocator returns the Allocator the World creates and frees entity IDs with.
+// Unless set by SetAllocator, it is the allocator of NewBasic and NewBasics,
+// which every such World shares.
+func (w *World) Allocator() Allocator {
+	if w.allocator == nil {
+		return &defaultAllocator
 	}
+	return w.allocator
+}
 
-	w.systems = append(w.systems, system)
-	sort.Sort(w.systems)
+// NewEntity creates a new Entity with an identifier from the World's Allocator.
+// Without SetAllocator the IDs of every World come from one shared allocator,
+// so they interleave across worlds and are only deterministic per World once it
+// has an Allocator of its own.
+func (w *World) NewEntity() BasicEntity {
+	return BasicEntity{id: w.Allocator().NewID(), shared: w.allocator == nil}
+}
+
+// NewEntities creates an amount of new entities with identifiers from the
+// World's Allocator, see NewEntity.
+func (w *World) NewEntities(amount int) []BasicEntity {
+	entities := make([]BasicEntity, amount)
+
+	for i, id := range w.Allocator().NewIDs(amount) {
+		entities[i].id = id
+		entities[i].shared = w.allocator == nil
+	}
+
+	return entities
+}
+
+// AddSystem adds the given System to the World, in StageUpdate unless the
+// InStage option is given. Within its stage it is sorted by its ordering
+// constraints and priority; constraints on systems in other stages are ignored.
+// It panics with a *CycleError if the ordering constraints of the systems
+// contradict each other, in which case the System is not added, and if the stage
+// does not exist. See TryAddSystem for a variant returning an error instead.
+func (w *World) AddSystem(system System, opts ...SystemOption) {
+	if err := w.TryAddSystem(system, opts...); err != nil {
+		panic(err)
+	}
+}
+
+// TryAddSystem is AddSystem, but returns ErrClosed if the World is closed, an
+// error wrapping ErrUnknownStage if the stage does not exist, and a *CycleError
+// if the ordering constraints of the systems contradict each other, in which
+// cases the System is not added. If the cycle is only formed by the systems its
+// New added, the System is finalized before the error is returned, and
+// the error of Finalize is dropped.
+func (w *World) TryAddSystem(system System, opts ...SystemOption) error {
+	return w.tryAddSystem(system, nil, opts)
+}
+
+// tryAddSystem adds the System with the filter it was added with by
+// AddSystemInterface, if any.
+func (w *World) tryAddSystem(system System, filter *systemFilter, opts []SystemOption) error {
+	if w.closed {
+		return ErrClosed
+	}
+	c := systemConfig{stage: StageUpdate}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	s := w.stage(c.stage)
+	if s == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownStage, c.stage)
+	}
+
+	// The constraints are checked again after initializing the System, which
+	// may add systems itself.
+	if _, _, err := s.orderWith(system, filter); err != nil {
+		return err
+	}
+	initializer, initialized := system.(Initializer)
+	if initialized {
+		initializer.New(w)
+	}
+	list, filters, err := s.orderWith(system, filter)
+	if err != nil {
+		if finalizer, ok := system.(Finalizer); ok && initialized {
+			finalizer.Finalize(w)
+		}
+		return err
+	}
+	s.setSystems(list, filters)
+	w.rebuildSystems()
+	return nil
 }
 
 // AddSystemInterface adds a system to the world, but also adds a filter that allows
 // automatic adding of entities that match the provided in interface, and excludes any
 // that match the provided ex interface, even if they also match in. in and ex must be
-// pointers to the interface or else this panics.
-func (w *World) AddSystemInterface(sys SystemAddByInterfacer, in interface{}, ex interface{}) {
-	w.AddSystem(sys)
+// pointers to the interface or else this panics. The filters belong to the given
+// instance, so several systems of the same type may filter differently. Entities
+// added to the World before are added to the system right away. The options are
+// those of AddSystem.
+// Adding a system again adds it once more, extending its filters, unless its
+// type is not comparable, in which case every addition keeps its own. See
+// TryAddSystemInterface for a variant returning an error instead.
+func (w *World) AddSystemInterface(sys SystemAddByInterfacer, in interface{}, ex interface{}, opts ...SystemOption) {
+	if err := w.addSystemInterface(sys, in, ex, opts); err != nil {
+		panic(err)
+	}
+}
 
-	if w.sysIn == nil {
-		w.sysIn = make(map[reflect.Type][]reflect.Type)
+// TryAddSystemInterface is AddSystemInterface, but returns a *FilterError when in
+// or ex are not pointers to interfaces, ErrSystemRegistered when the System was
+// already added, and the errors of TryAddSystem, in which cases the System is
+// not added.
+func (w *World) TryAddSystemInterface(sys SystemAddByInterfacer, in interface{}, ex interface{}, opts ...SystemOption) error {
+	if containsSystem(w.systems, sys) {
+		return ErrSystemRegistered
 	}
+	return w.addSystemInterface(sys, in, ex, opts)
+}
 
-	if !reflect.TypeOf(in).AssignableTo(reflect.TypeOf([]interface{}{})) {
-		in = []interface{}{in}
+// addSystemInterface adds the system with its filters, if they are valid.
+func (w *World) addSystemInterface(sys SystemAddByInterfacer, in interface{}, ex interface{}, opts []SystemOption) error {
+	inTypes, err := filterTypes(in)
+	if err != nil {
+		return err
 	}
-	for _, v := range in.([]interface{}) {
-		w.sysIn[reflect.TypeOf(sys)] = append(w.sysIn[reflect.TypeOf(sys)], reflect.TypeOf(v).Elem())
+	var exTypes []reflect.Type
+	if ex != nil {
+		if exTypes, err = filterTypes(ex); err != nil {
+			return err
+		}
 	}
 
-	if ex == nil {
-		return
+	// A System added again shares its filter, while a System of an
+	// uncomparable type cannot be found again and gets a filter of its own.
+	f := w.filterOf(sys)
+	added := f == nil
+	if added {
+		f = &systemFilter{sys: sys}
 	}
+	if err := w.tryAddSystem(sys, f, opts); err != nil {
+		return err
+	}
+	if added {
+		w.filters = append(w.filters, f)
+	}
+	f.in = append(f.in, inTypes...)
+	f.ex = append(f.ex, exTypes...)
 
-	if w.sysEx == nil {
-		w.sysEx = make(map[reflect.Type][]reflect.Type)
+	for _, e := range append([]Identifier(nil), w.entities.Entities()...) {
+		if f.matches(e) {
+			sys.AddByInterface(e)
+		}
 	}
+	return nil
+}
 
-	if !reflect.TypeOf(ex).AssignableTo(reflect.TypeOf([]interface{}{})) {
-		ex = []interface{}{ex}
+// systemFilter holds the interfaces an entity must implement, and may not
+// implement, to be added to a System added by AddSystemInterface.
+type systemFilter struct {
+	sys    SystemAddByInterfacer
+	in, ex []reflect.Type
+}
+
+// matches reports whether the entity passes the filter.
+func (f *systemFilter) matches(e Identifier) bool {
+	typ := reflect.TypeOf(e)
+	for _, t := range f.ex {
+		if typ.Implements(t) {
+			return false
+		}
 	}
-	for _, v := range ex.([]interface{}) {
-		w.sysEx[reflect.TypeOf(sys)] = append(w.sysEx[reflect.TypeOf(sys)], reflect.TypeOf(v).Elem())
+	for _, t := range f.in {
+		if typ.Implements(t) {
+			return true
+		}
 	}
+	return false
 }
 
-// AddEntity adds the entity to all systems that have been added via
-// AddSystemInterface. If the system was added via AddSystem the entity will not be
-// added to it.
-func (w *World) AddEntity(e Identifier) {
-	if w.sysIn == nil {
-		w.sysIn = make(map[reflect.Type][]reflect.Type)
+// filterOf returns the filter the given System was added with, or nil.
+func (w *World) filterOf(sys System) *systemFilter {
+	for _, f := range w.filters {
+		if sameSystem(f.sys, sys) {
+			return f
+		}
+	}
+	return nil
+}
+
+// filterTypes returns the interface types of a filter of AddSystemInterface,
+// which is either a pointer to an interface or a slice of them.
+func filterTypes(filter interface{}) ([]reflect.Type, error) {
+	filters, ok := filter.([]interface{})
+	if !ok {
+		filters = []interface{}{filter}
 	}
-	if w.sysEx == nil {
-		w.sysEx = make(map[reflect.Type][]reflect.Type)
+
+	types := make([]reflect.Type, 0, len(filters))
+	for _, f := range filters {
+		typ := reflect.TypeOf(f)
+		if typ == nil || typ.Kind() != reflect.Ptr {
+			return nil, &FilterError{Filter: f, Err: ErrNotPointer}
+		}
+		if typ.Elem().Kind() != reflect.Interface {
+			return nil, &FilterError{Filter: f, Err: ErrNotInterface}
+		}
+		types = append(types, typ.Elem())
 	}
+	return types, nil
+}
 
-	search := func(i Identifier, types []reflect.Type) bool {
-		for _, t := range types {
-			if reflect.TypeOf(i).Implements(t) {
-				return true
+// RemoveSystem removes the given System from the World, along with the filters
+// it was added with by AddSystemInterface. If it implements Finalizer, it is
+// finalized afterwards and its error is returned. It does nothing if the System
+// was not added to the World, or if its type is not comparable, since such a
+// System cannot be told apart from its copies; Close still finalizes those.
+func (w *World) RemoveSystem(system System) error {
+	found := false
+	for _, s := range w.stageList() {
+		kept := make(systems, 0, len(s.systems))
+		keptFilters := make([]*systemFilter, 0, len(s.systems))
+		for i, sys := range s.systems {
+			if !sameSystem(sys, system) {
+				kept = append(kept, sys)
+				keptFilters = append(keptFilters, s.filters[i])
 			}
 		}
-		return false
-	}
-	for _, system := range w.systems {
-		sys, ok := system.(SystemAddByInterfacer)
-		if !ok {
-			continue
+		if len(kept) < len(s.systems) {
+			s.setSystems(kept, keptFilters)
+			found = true
 		}
+	}
+	if !found {
+		return nil
+	}
+	w.rebuildSystems()
+	w.SetSystemEnabled(system, true)
 
-		if ex, not := w.sysEx[reflect.TypeOf(sys)]; not {
-			if search(e, ex) {
-				continue
-			}
+	for i, f := range w.filters {
+		if sameSystem(f.sys, system) {
+			w.filters = append(w.filters[:i], w.filters[i+1:]...)
+			break
 		}
-		if in, ok := w.sysIn[reflect.TypeOf(sys)]; ok {
-			if search(e, in) {
-				sys.AddByInterface(e)
-				continue
-			}
+	}
+
+	if finalizer, ok := system.(Finalizer); ok {
+		return finalizer.Finalize(w)
+	}
+	return nil
+}
+
+// AddEntity adds the entity to all systems that have been added via
+// AddSystemInterface. If the system was added via AddSystem the entity will not be
+// added to it. The World keeps track of the entity until it is removed, to add it
+// to systems added later on.
+func (w *World) AddEntity(e Identifier) {
+	w.checkOpen()
+	w.checkStructural()
+	w.entities.Add(e)
+	for _, f := range w.systemFilters {
+		if f != nil && f.matches(e) {
+			f.sys.AddByInterface(e)
 		}
 	}
 }
 
+// Entity returns the entity with the given ID added by AddEntity, and whether
+// there is one. Entities are tracked until they are removed by RemoveEntity.
+func (w *World) Entity(id uint64) (Identifier, bool) {
+	return w.entities.Get(id)
+}
+
+// Len returns the number of entities added by AddEntity and not removed since.
+func (w *World) Len() int {
+	return w.entities.Len()
+}
+
+// Each calls fn for every entity added by AddEntity and not removed since, in no
+// particular order. Entities added or removed by fn are not taken into account
+// until Each returns.
+func (w *World) Each(fn func(Identifier)) {
+	for _, e := range append([]Identifier(nil), w.entities.Entities()...) {
+		fn(e)
+	}
+}
+
 // Systems returns the list of Systems managed by the World.
 func (w *World) Systems() []System {
 	return w.systems
 }
 
-// Update updates each System managed by the World. It is invoked by the engine
-// once every frame, with dt being the duration since the previous update.
+// SetSystemEnabled enables or disables the given System. Update skips disabled
+// systems, but they are still added and removed entities like any other System,
+// so they are up to date when enabled again. Systems are enabled when added,
+// and it has no effect on systems not added to the World.
+func (w *World) SetSystemEnabled(system System, enabled bool) {
+	if enabled {
+		if !w.SystemEnabled(system) {
+			delete(w.disabled, system)
+		}
+		return
+	}
+	for _, sys := range w.systems {
+		if sameSystem(sys, system) {
+			if w.disabled == nil {
+				w.disabled = make(map[System]struct{})
+			}
+			w.disabled[system] = struct{}{}
+			return
+		}
+	}
+}
+
+// SystemEnabled reports whether the given System is enabled, see
+// SetSystemEnabled.
+func (w *World) SystemEnabled(system System) bool {
+	if len(w.disabled) == 0 {
+		return true
+	}
+	// Only systems of comparable types can be found in the World, and thus be
+	// disabled; looking up others would panic.
+	if typ := reflect.TypeOf(system); typ == nil || !typ.Comparable() {
+		return true
+	}
+	_, disabled := w.disabled[system]
+	return !disabled
+}
+
+// Update updates each enabled System managed by the World. It is invoked by the engine
+// once every frame, with dt being the duration since the previous update. The
+// recorded Commands are applied before the first System, and after every
+// System. See SetWorkers for updating systems in parallel.
 func (w *World) Update(dt float32) {
-	for _, system := range w.Systems() {
-		system.Update(dt)
+	w.checkOpen()
+	w.trimRemovals()
+	w.FlushCommands()
+	for _, s := range w.stageList() {
+		w.updateStage(s, dt)
 	}
 }
 
-// RemoveEntity removes the entity across all systems.
-func (w *World) RemoveEntity(e BasicEntity) {
+// RemoveEntity removes the entity across all systems and component storages,
+// and frees its ID so that IsAlive reports false for any copies of it still held.
+// Its children are left alone, see RemoveEntityTree for removing them as well.
+func (w *World) RemoveEntity(e Identifier) {
+	w.checkStructural()
+	basic := basicEntityOf(e)
 	for _, sys := range w.systems {
-		sys.Remove(e)
+		sys.Remove(basic)
+	}
+	w.entities.RemoveID(e.ID())
+	w.removeComponents(e.ID())
+	w.allocatorOf(basic).Free(e.ID())
+}
+
+// RemoveEntityTree removes the entity and all of its descendents, see
+// RemoveEntity, after detaching it from its parent. Descendents are removed
+// before their parents.
+func (w *World) RemoveEntityTree(e BasicFace) {
+	w.checkStructural()
+	basic := e.GetBasicEntity()
+	if parent := basic.Parent(); parent != nil {
+		parent.RemoveChild(basic)
+	}
+
+	for _, child := range basic.Descendents() {
+		w.RemoveEntity(child)
+	}
+	w.RemoveEntity(*basic)
+}
+
+// basicEntityOf returns the BasicEntity passed to System.Remove for the entity.
+func basicEntityOf(e Identifier) BasicEntity {
+	switch e := e.(type) {
+	case BasicEntity:
+		return e
+	case BasicFace:
+		return *e.GetBasicEntity()
+	}
+	return BasicEntity{id: e.ID()}
+}
+
+// IsAlive reports whether the entity was created and has not been removed from
+// the World since. Systems may use it to detect stale references to entities.
+func (w *World) IsAlive(e Identifier) bool {
+	return w.allocatorOf(basicEntityOf(e)).IsAlive(e.ID())
+}
+
+// allocatorOf returns the Allocator which handed out the ID of the entity.
+func (w *World) allocatorOf(e BasicEntity) Allocator {
+	if e.shared {
+		return &defaultAllocator
+	}
+	return w.Allocator()
+}
+
+// Close removes every System from the World in the reverse order of updating
+// them, finalizing those implementing Finalizer. The World may not be used
+// afterwards: Update, AddSystem and AddEntity panic with ErrClosed. It returns
+// a *CloseError holding the errors of the systems which failed to finalize.
+// Systems added several times are finalized once, unless their type is not
+// comparable, in which case every copy is finalized.
+func (w *World) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+
+	// The systems are removed by position, as RemoveSystem cannot find those of
+	// uncomparable types, and every copy of a System but the last is skipped.
+	var finalized []System
+	var errs []error
+	stages := w.stageList()
+	for k := len(stages) - 1; k >= 0; k-- {
+		s := stages[k]
+		list, filters := s.systems, s.filters
+		for i := len(list) - 1; i >= 0; i-- {
+			s.setSystems(list[:i], filters[:i])
+			w.rebuildSystems()
+
+			sys := list[i]
+			if containsSystem(finalized, sys) {
+				continue
+			}
+			finalized = append(finalized, sys)
+			if finalizer, ok := sys.(Finalizer); ok {
+				if err := finalizer.Finalize(w); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", systemName(sys), err))
+				}
+			}
+		}
 	}
+	w.filters, w.disabled = nil, nil
+	w.closed = true
+
+	if errs != nil {
+		return &CloseError{Errors: errs}
+	}
+	return nil
 }
 
-// SortSystems sorts the systems in the world.
+// containsSystem reports whether the list holds the given System.
+func containsSystem(list []System, system System) bool {
+	for _, sys := range list {
+		if sameSystem(sys, system) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOpen panics with ErrClosed if the World is closed.
+func (w *World) checkOpen() {
+	if w.closed {
+		panic(ErrClosed)
+	}
+}
+
+// checkStructural panics if entities or components may not be added or removed
+// right now, because a query is being iterated over in parallel.
+func (w *World) checkStructural() {
+	if atomic.LoadInt32(&w.iterating) > 0 {
+		panic("ecs: entities and components may not be added or removed during ParEach, record them in the Commands instead")
+	}
+}
+
+// SortSystems sorts the systems in every stage of the world. It panics with a
+// *CycleError if the ordering constraints of the systems contradict each other.
 func (w *World) SortSystems() {
-	sort.Sort(w.systems)
+	for _, s := range w.stageList() {
+		list, filters, err := ordered(s.systems, s.filters)
+		if err != nil {
+			panic(err)
+		}
+		s.setSystems(list, filters)
+	}
+	w.rebuildSystems()
 }
@@ -1,6 +1,10 @@
 package ecs
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -139,3 +143,581 @@ func TestWorld_SortSystems(t *testing.T) {
 		}
 	}
 }
+
+// TestWorld_SetAllocator makes sure worlds with their own allocators do not share IDs
+func TestWorld_SetAllocator(t *testing.T) {
+	client, server := new(World), new(World)
+	client.SetAllocator(&IDAllocator{})
+	server.SetAllocator(&IDAllocator{})
+
+	clientEntities := client.NewEntities(3)
+	serverEntities := server.NewEntities(3)
+	for i := range clientEntities {
+		if clientEntities[i].ID() != serverEntities[i].ID() {
+			t.Errorf("Worlds with their own allocators did not create the same IDs: %d != %d", clientEntities[i].ID(), serverEntities[i].ID())
+		}
+	}
+
+	client.RemoveEntity(clientEntities[0])
+	if client.IsAlive(clientEntities[0]) {
+		t.Error("Removed entity is still alive in its world")
+	}
+	if !server.IsAlive(serverEntities[0]) {
+		t.Error("Removing an entity from one world killed an entity in another")
+	}
+
+	e := client.NewEntity()
+	if IDIndex(e.ID()) != IDIndex(clientEntities[0].ID()) {
+		t.Error("World did not recycle the index of the removed entity")
+	}
+}
+
+// TestWorld_MixedAllocators makes sure removing an entity of NewBasic from a
+// World with its own allocator does not free an entity of the World
+func TestWorld_MixedAllocators(t *testing.T) {
+	w := new(World)
+	w.SetAllocator(&IDAllocator{})
+	own := w.NewEntity()
+	basic := NewBasic()
+
+	w.RemoveEntity(&simpleEntity{basic})
+	if !w.IsAlive(own) {
+		t.Error("Removing an entity of NewBasic freed an entity of the World")
+	}
+	if w.IsAlive(basic) || defaultAllocator.IsAlive(basic.ID()) {
+		t.Error("Removing an entity of NewBasic did not free its ID")
+	}
+}
+
+func TestWorld_DefaultAllocator(t *testing.T) {
+	w := new(World)
+	e := NewBasic()
+	if !w.IsAlive(e) {
+		t.Error("World without an allocator does not share the one of NewBasic")
+	}
+	w.RemoveEntity(e)
+	if defaultAllocator.IsAlive(e.ID()) {
+		t.Error("World without an allocator did not free the ID of NewBasic")
+	}
+}
+
+// countingSystem is a simpleSystem counting its updates and removed entities.
+type countingSystem struct {
+	simpleSystem
+	updates, removed int
+}
+
+func (s *countingSystem) Remove(b BasicEntity) { s.removed++ }
+
+func (s *countingSystem) Update(dt float32) { s.updates++ }
+
+func TestWorld_SetSystemEnabled(t *testing.T) {
+	for _, workers := range []int{1, 2} {
+		w := new(World)
+		w.SetWorkers(workers)
+		sys, other := new(countingSystem), new(countingSystem)
+		var face *BasicFace
+		w.AddSystemInterface(sys, face, nil)
+		w.AddSystem(other)
+
+		w.SetSystemEnabled(sys, false)
+		if w.SystemEnabled(sys) || !w.SystemEnabled(other) {
+			t.Error("SystemEnabled does not report the disabled system")
+		}
+		w.Update(1)
+		if sys.updates != 0 || other.updates != 1 {
+			t.Errorf("Disabled system was updated, or enabled system was not: %d, %d", sys.updates, other.updates)
+		}
+
+		e := &simpleEntity{w.NewEntity()}
+		w.AddEntity(e)
+		w.RemoveEntity(e.BasicEntity)
+		if len(sys.entities) != 1 || sys.removed != 1 {
+			t.Error("Disabled system was not added and removed the entity")
+		}
+
+		w.SetSystemEnabled(sys, true)
+		w.Update(1)
+		if sys.updates != 1 {
+			t.Error("Enabled system was not updated")
+		}
+	}
+}
+
+// finalizingSystem is a countingSystem implementing Finalizer.
+type finalizingSystem struct {
+	countingSystem
+	finalized int
+	err       error
+}
+
+func (s *finalizingSystem) Finalize(w *World) error {
+	s.finalized++
+	return s.err
+}
+
+func TestWorld_RemoveSystem(t *testing.T) {
+	w := new(World)
+	sys := &finalizingSystem{err: errors.New("finalize")}
+	other := new(countingSystem)
+	var face *BasicFace
+	w.AddSystemInterface(sys, face, nil)
+	w.AddSystem(other, InStage(StageRender))
+	w.SetSystemEnabled(sys, false)
+
+	if err := w.RemoveSystem(sys); err != sys.err {
+		t.Errorf("RemoveSystem did not return the error of Finalize: %v", err)
+	}
+	if sys.finalized != 1 {
+		t.Error("RemoveSystem did not finalize the system")
+	}
+	if len(w.Systems()) != 1 || w.Systems()[0] != other {
+		t.Error("RemoveSystem did not remove the system")
+	}
+	if w.filterOf(sys) != nil {
+		t.Error("RemoveSystem did not remove the filters of the system")
+	}
+	if !w.SystemEnabled(sys) {
+		t.Error("Removed system is still disabled")
+	}
+
+	w.Update(1)
+	w.AddEntity(&simpleEntity{w.NewEntity()})
+	if sys.updates != 0 || len(sys.entities) != 0 {
+		t.Error("Removed system is still updated or added entities")
+	}
+
+	if err := w.RemoveSystem(sys); err != nil || sys.finalized != 1 {
+		t.Error("Removing a system twice finalized it again")
+	}
+}
+
+func TestWorld_RemoveSystemsWhileRanging(t *testing.T) {
+	w := new(World)
+	for i := 0; i < 3; i++ {
+		w.AddSystem(new(countingSystem))
+	}
+
+	for _, sys := range w.Systems() {
+		w.RemoveSystem(sys)
+	}
+	if n := len(w.Systems()); n != 0 {
+		t.Errorf("%d systems were left after removing all of them", n)
+	}
+}
+
+// closingSystem is a finalizingSystem recording the order systems are
+// finalized in.
+type closingSystem struct {
+	finalizingSystem
+	name  string
+	order *[]string
+}
+
+func (s *closingSystem) Finalize(w *World) error {
+	*s.order = append(*s.order, s.name)
+	return s.finalizingSystem.Finalize(w)
+}
+
+func TestWorld_Close(t *testing.T) {
+	w := new(World)
+	var order []string
+	errFirst, errLast := errors.New("first"), errors.New("last")
+	first := &closingSystem{finalizingSystem: finalizingSystem{err: errFirst}, name: "first", order: &order}
+	second := &closingSystem{name: "second", order: &order}
+	last := &closingSystem{finalizingSystem: finalizingSystem{err: errLast}, name: "last", order: &order}
+	w.AddSystem(last, InStage(StageRender))
+	w.AddSystem(first, InStage(StagePreUpdate))
+	w.AddSystem(second)
+	w.AddSystem(new(countingSystem))
+
+	err := w.Close()
+	if !reflect.DeepEqual(order, []string{"last", "second", "first"}) {
+		t.Errorf("Close did not finalize the systems in reverse order: %v", order)
+	}
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || len(closeErr.Errors) != 2 {
+		t.Fatalf("Close did not return both errors: %v", err)
+	}
+	if !errors.Is(closeErr.Errors[0], errLast) || !errors.Is(closeErr.Errors[1], errFirst) {
+		t.Errorf("Close did not return the errors in order: %v", err)
+	}
+	if !closeErr.Is(errFirst) || !closeErr.Is(errLast) || closeErr.Is(ErrClosed) {
+		t.Error("CloseError does not match the errors of the systems")
+	}
+	var pathErr *os.PathError
+	if !(&CloseError{Errors: []error{errFirst, fmt.Errorf("wrapped: %w", &os.PathError{})}}).As(&pathErr) {
+		t.Error("CloseError does not find the errors of the systems")
+	}
+	if len(w.Systems()) != 0 {
+		t.Error("Close did not remove the systems")
+	}
+
+	if err := w.Close(); err != ErrClosed {
+		t.Errorf("Closing a world twice did not return ErrClosed: %v", err)
+	}
+	for name, f := range map[string]func(){
+		"Update":    func() { w.Update(1) },
+		"AddEntity": func() { w.AddEntity(&simpleEntity{NewBasic()}) },
+		"AddSystem": func() { w.AddSystem(new(countingSystem)) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != ErrClosed {
+					t.Errorf("%s on a closed world did not panic with ErrClosed: %v", name, r)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestWorld_CloseDuplicates(t *testing.T) {
+	w := new(World)
+	a, b := new(finalizingSystem), new(finalizingSystem)
+	var face *BasicFace
+	w.AddSystemInterface(a, face, nil)
+	w.AddSystemInterface(b, face, nil)
+	w.AddSystemInterface(a, face, nil)
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+	if a.finalized != 1 || b.finalized != 1 {
+		t.Errorf("Close finalized the systems %d and %d times", a.finalized, b.finalized)
+	}
+	if len(w.Systems()) != 0 {
+		t.Error("Close did not remove the systems")
+	}
+}
+
+// uncomparableSystem is a System of an uncomparable type, which counts how often
+// it was finalized.
+type uncomparableSystem struct {
+	finalized *int
+	tags      []string
+}
+
+func (s uncomparableSystem) Finalize(*World) error { *s.finalized++; return nil }
+func (s uncomparableSystem) Remove(BasicEntity)    {}
+func (s uncomparableSystem) Update(float32)        {}
+
+// TestWorld_CloseUncomparable makes sure systems of uncomparable types, which
+// RemoveSystem cannot find, are finalized by Close
+func TestWorld_CloseUncomparable(t *testing.T) {
+	w := new(World)
+	var finalized int
+	sys := uncomparableSystem{finalized: &finalized}
+	w.AddSystem(sys)
+	w.AddSystem(sys, InStage(StageRender))
+
+	if err := w.RemoveSystem(sys); err != nil || finalized != 0 || len(w.Systems()) != 2 {
+		t.Error("RemoveSystem found a system of an uncomparable type")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned an error: %v", err)
+	}
+	if finalized != 2 {
+		t.Errorf("Close finalized the copies of the system %d times, expected 2", finalized)
+	}
+	if len(w.Systems()) != 0 {
+		t.Error("Close did not remove the systems")
+	}
+}
+
+func TestWorld_TryAddSystemInterface(t *testing.T) {
+	var face *BasicFace
+	var notInterface *BasicEntity
+	tests := []struct {
+		name string
+		in   interface{}
+		ex   interface{}
+		err  error
+	}{
+		{"accepts pointers to interfaces", face, []interface{}{face}, nil},
+		{"rejects nil", nil, nil, ErrNotPointer},
+		{"rejects values", BasicEntity{}, nil, ErrNotPointer},
+		{"rejects pointers to other types", face, notInterface, ErrNotInterface},
+		{"rejects invalid filters in slices", []interface{}{face, 1}, nil, ErrNotPointer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := new(World)
+			sys := new(simpleSystem)
+			err := w.TryAddSystemInterface(sys, tt.in, tt.ex)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("TryAddSystemInterface returned %v, expected %v", err, tt.err)
+			}
+			var filterErr *FilterError
+			if err != nil && !errors.As(err, &filterErr) {
+				t.Errorf("TryAddSystemInterface did not return a *FilterError: %v", err)
+			}
+			if added := len(w.Systems()) == 1; added != (err == nil) {
+				t.Errorf("TryAddSystemInterface added the system: %v, returned: %v", added, err)
+			}
+		})
+	}
+
+	w := new(World)
+	sys := new(simpleSystem)
+	w.AddSystemInterface(sys, face, nil)
+	if err := w.TryAddSystemInterface(sys, face, nil); err != ErrSystemRegistered {
+		t.Errorf("Adding a system twice did not return ErrSystemRegistered: %v", err)
+	}
+	if len(w.Systems()) != 1 || len(w.filters) != 1 {
+		t.Error("Adding a system twice changed the systems or filters")
+	}
+	// AddSystemInterface accepts it, like it always did
+	var a *layerAFace
+	w.AddSystemInterface(sys, a, nil)
+	if len(w.Systems()) != 2 || len(w.filters) != 1 || len(w.filters[0].in) != 2 {
+		t.Error("AddSystemInterface did not add the system again, extending its filters")
+	}
+	w.RemoveSystem(sys)
+	if len(w.Systems()) != 0 || len(w.filters) != 0 {
+		t.Error("RemoveSystem did not remove every occurrence of the system")
+	}
+
+	if err := w.TryAddSystemInterface(sys, face, nil, InStage("Missing")); !errors.Is(err, ErrUnknownStage) {
+		t.Errorf("Adding a system to a missing stage did not return ErrUnknownStage: %v", err)
+	}
+	var cycle *CycleError
+	var log []string
+	w.AddSystem(&orderedSystem{label: "first", before: []interface{}{"second"}, log: &log})
+	second := &interfaceOrderedSystem{orderedSystem{label: "second", before: []interface{}{"first"}, log: &log}}
+	if err := w.TryAddSystemInterface(second, face, nil); !errors.As(err, &cycle) {
+		t.Errorf("Adding a system forming a cycle did not return a *CycleError: %v", err)
+	}
+	if len(w.Systems()) != 1 || len(w.filters) != 0 {
+		t.Error("A system which could not be added was added anyway")
+	}
+	w.Close()
+	if err := w.TryAddSystemInterface(sys, face, nil); err != ErrClosed {
+		t.Errorf("Adding a system to a closed world did not return ErrClosed: %v", err)
+	}
+}
+
+// interfaceOrderedSystem is an orderedSystem which can be added by interface.
+type interfaceOrderedSystem struct {
+	orderedSystem
+}
+
+func (*interfaceOrderedSystem) AddByInterface(Identifier) {}
+
+type layerAFace interface {
+	layerA()
+}
+
+type layerBFace interface {
+	layerB()
+}
+
+type layerAEntity struct{ simpleEntity }
+
+func (*layerAEntity) layerA() {}
+
+type layerBEntity struct{ simpleEntity }
+
+func (*layerBEntity) layerB() {}
+
+type layerABEntity struct{ simpleEntity }
+
+func (*layerABEntity) layerA() {}
+func (*layerABEntity) layerB() {}
+
+// TestWorld_AddSystemInterfaceInstances makes sure every instance of a system
+// type keeps its own filters
+func TestWorld_AddSystemInterfaceInstances(t *testing.T) {
+	w := new(World)
+	var a *layerAFace
+	var b *layerBFace
+	onlyA, onlyB, either := new(simpleSystem), new(simpleSystem), new(simpleSystem)
+	w.AddSystemInterface(onlyA, a, b)
+	w.AddSystemInterface(onlyB, b, a)
+	w.AddSystemInterface(either, []interface{}{a, b}, nil)
+
+	w.AddEntity(&layerAEntity{simpleEntity{w.NewEntity()}})
+	w.AddEntity(&layerBEntity{simpleEntity{w.NewEntity()}})
+	w.AddEntity(&layerABEntity{simpleEntity{w.NewEntity()}})
+
+	for name, tt := range map[string]struct {
+		sys  *simpleSystem
+		want int
+	}{
+		"onlyA":  {onlyA, 1},
+		"onlyB":  {onlyB, 1},
+		"either": {either, 3},
+	} {
+		if len(tt.sys.entities) != tt.want {
+			t.Errorf("%s got %d entities, expected %d", name, len(tt.sys.entities), tt.want)
+		}
+	}
+
+	w.RemoveSystem(onlyA)
+	w.AddEntity(&layerBEntity{simpleEntity{w.NewEntity()}})
+	if len(onlyB.entities) != 2 {
+		t.Error("Removing a system removed the filters of another instance")
+	}
+}
+
+// mapSystem is a System of an uncomparable type, which records the entities it
+// is given.
+type mapSystem struct {
+	entities map[uint64]Identifier
+	priority int
+}
+
+func (s mapSystem) AddByInterface(i Identifier) { s.entities[i.ID()] = i }
+func (s mapSystem) Priority() int               { return s.priority }
+func (s mapSystem) Remove(BasicEntity)          {}
+func (s mapSystem) Update(float32)              {}
+
+// TestWorld_AddSystemInterfaceUncomparable makes sure systems of uncomparable
+// types get the entities matching their own filters, even once sorted
+func TestWorld_AddSystemInterfaceUncomparable(t *testing.T) {
+	w := new(World)
+	var a *layerAFace
+	var b *layerBFace
+	onlyA := mapSystem{entities: map[uint64]Identifier{}}
+	onlyB := mapSystem{entities: map[uint64]Identifier{}, priority: 1}
+	w.AddSystemInterface(onlyA, a, nil)
+	w.AddEntity(&layerAEntity{simpleEntity{w.NewEntity()}})
+	w.AddSystemInterface(onlyB, b, nil)
+	w.AddEntity(&layerBEntity{simpleEntity{w.NewEntity()}})
+	w.AddEntity(&layerABEntity{simpleEntity{w.NewEntity()}})
+
+	if len(onlyA.entities) != 2 || len(onlyB.entities) != 2 {
+		t.Errorf("Uncomparable systems got %d and %d entities, expected 2 each", len(onlyA.entities), len(onlyB.entities))
+	}
+}
+
+// TestWorld_AddSystemInterfaceLate makes sure systems added after entities are
+// offered the entities added before
+func TestWorld_AddSystemInterfaceLate(t *testing.T) {
+	w := new(World)
+	removed := &layerAEntity{simpleEntity{w.NewEntity()}}
+	w.AddEntity(&layerAEntity{simpleEntity{w.NewEntity()}})
+	w.AddEntity(&layerBEntity{simpleEntity{w.NewEntity()}})
+	w.AddEntity(removed)
+	w.RemoveEntity(removed.BasicEntity)
+
+	sys := new(simpleSystem)
+	var a *layerAFace
+	w.AddSystemInterface(sys, a, nil)
+	if len(sys.entities) != 1 {
+		t.Errorf("System added late got %d entities, expected 1", len(sys.entities))
+	}
+
+	w.AddEntity(&layerAEntity{simpleEntity{w.NewEntity()}})
+	if len(sys.entities) != 2 {
+		t.Error("System added late did not get a new entity")
+	}
+}
+
+func TestWorld_Entities(t *testing.T) {
+	w := new(World)
+	es := []*simpleEntity{{w.NewEntity()}, {w.NewEntity()}, {w.NewEntity()}}
+	for _, e := range es {
+		w.AddEntity(e)
+	}
+	w.RemoveEntity(es[1].BasicEntity)
+
+	if w.Len() != 2 {
+		t.Errorf("Len returned %d, expected 2", w.Len())
+	}
+	if e, ok := w.Entity(es[0].ID()); !ok || e != es[0] {
+		t.Error("Entity did not return the added entity")
+	}
+	if _, ok := w.Entity(es[1].ID()); ok {
+		t.Error("Entity returned a removed entity")
+	}
+
+	seen := map[uint64]bool{}
+	w.Each(func(e Identifier) {
+		seen[e.ID()] = true
+		w.RemoveEntity(*e.(*simpleEntity).GetBasicEntity())
+	})
+	if len(seen) != 2 || !seen[es[0].ID()] || !seen[es[2].ID()] {
+		t.Errorf("Each did not visit every entity: %v", seen)
+	}
+	if w.Len() != 0 {
+		t.Error("Entities removed during Each were not removed")
+	}
+}
+
+func TestWorld_RemoveEntityIdentifier(t *testing.T) {
+	w := new(World)
+	sys := new(countingSystem)
+	var face *BasicFace
+	w.AddSystemInterface(sys, face, nil)
+
+	e := &simpleEntity{w.NewEntity()}
+	w.AddEntity(e)
+	w.RemoveEntity(e)
+	if sys.removed != 1 || w.Len() != 0 || w.IsAlive(e) {
+		t.Error("RemoveEntity did not remove an entity passed as its Identifier")
+	}
+}
+
+func TestWorld_RemoveEntityTree(t *testing.T) {
+	w := new(World)
+	sys := new(countingSystem)
+	var face *BasicFace
+	w.AddSystemInterface(sys, face, nil)
+
+	parent, root, a, b, c := w.NewEntity(), w.NewEntity(), w.NewEntity(), w.NewEntity(), w.NewEntity()
+	parent.AppendChild(&root)
+	root.AppendChild(&a)
+	a.AppendChild(&b)
+	root.AppendChild(&c)
+	for _, e := range []*BasicEntity{&parent, &root, &a, &b, &c} {
+		w.AddEntity(e)
+	}
+
+	w.RemoveEntityTree(&root)
+	if sys.removed != 4 {
+		t.Errorf("RemoveEntityTree removed %d entities from the system, expected 4", sys.removed)
+	}
+	for _, e := range []*BasicEntity{&root, &a, &b, &c} {
+		if w.IsAlive(e) {
+			t.Errorf("RemoveEntityTree did not free entity %d", e.ID())
+		}
+		if _, ok := w.Entity(e.ID()); ok {
+			t.Errorf("RemoveEntityTree did not unregister entity %d", e.ID())
+		}
+	}
+	if !w.IsAlive(parent) || w.Len() != 1 {
+		t.Error("RemoveEntityTree removed the parent")
+	}
+	if len(parent.Children()) != 0 || root.Parent() != nil {
+		t.Error("RemoveEntityTree did not detach the entity from its parent")
+	}
+}
+
+// rawIdentifier is an Identifier whose ID does not come from an Allocator.
+type rawIdentifier uint64
+
+func (r rawIdentifier) ID() uint64 { return uint64(r) }
+
+// TestWorld_EntitiesArbitraryIDs makes sure the registry keys entities by their
+// whole ID, however it was made
+func TestWorld_EntitiesArbitraryIDs(t *testing.T) {
+	w := new(World)
+	ids := []rawIdentifier{1<<32 | 7, 7, 1 << 63}
+	for _, id := range ids {
+		w.AddEntity(id)
+	}
+	if w.Len() != len(ids) {
+		t.Errorf("Len returned %d, expected %d", w.Len(), len(ids))
+	}
+	for _, id := range ids {
+		if e, ok := w.Entity(uint64(id)); !ok || e != id {
+			t.Errorf("Entity did not return the entity with ID %d", uint64(id))
+		}
+	}
+
+	w.RemoveEntity(ids[0])
+	if _, ok := w.Entity(uint64(ids[1])); !ok || w.Len() != 2 {
+		t.Error("Removing an entity removed another with the same low bits")
+	}
+}